@@ -1,12 +1,12 @@
 module github.com/drone/drone-migrate
 
 require (
+	github.com/Azure/azure-storage-blob-go v0.7.0
 	github.com/aws/aws-sdk-go v1.19.40
 	github.com/dchest/uniuri v0.0.0-20160212164326-8902c56451e9
 	github.com/drone/drone-go v0.8.4
 	github.com/drone/go-scm v1.0.5
 	github.com/go-sql-driver/mysql v1.4.1
-	github.com/hashicorp/go-multierror v1.0.0
 	github.com/joho/godotenv v1.3.0
 	github.com/lib/pq v1.0.0
 	github.com/mattn/go-sqlite3 v1.10.0
@@ -4,11 +4,19 @@ import (
 	"crypto/rsa"
 	"crypto/x509"
 	"database/sql"
+	"encoding/json"
 	"encoding/pem"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/russross/meddler"
 
@@ -48,6 +56,31 @@ func main() {
 			Usage:  "Source database datasource",
 			EnvVar: "SOURCE_DATABASE_DATASOURCE",
 		},
+		cli.StringFlag{
+			Name:   "source-database-replica",
+			Usage:  "Source database replica datasource, from which the source database is read (optional)",
+			EnvVar: "SOURCE_DATABASE_REPLICA",
+		},
+		cli.Float64Flag{
+			Name:   "source-rows-per-second",
+			Usage:  "maximum number of rows read from the source database per second",
+			EnvVar: "SOURCE_ROWS_PER_SECOND",
+		},
+		cli.Float64Flag{
+			Name:   "source-queries-per-second",
+			Usage:  "maximum number of queries executed against the source database per second",
+			EnvVar: "SOURCE_QUERIES_PER_SECOND",
+		},
+		cli.DurationFlag{
+			Name:   "source-max-latency",
+			Usage:  "back off reading the source database when the query latency exceeds this value",
+			EnvVar: "SOURCE_MAX_LATENCY",
+		},
+		cli.BoolFlag{
+			Name:   "source-snapshot",
+			Usage:  "read the source database from a single consistent snapshot",
+			EnvVar: "SOURCE_SNAPSHOT",
+		},
 		cli.StringFlag{
 			Name:   "target-database-driver",
 			Usage:  "target database driver",
@@ -108,11 +141,146 @@ func main() {
 			Usage:  "s3 path prefix (optional)",
 			EnvVar: "S3_PREFIX",
 		},
+		cli.StringFlag{
+			Name:   "s3-endpoint",
+			Usage:  "s3-compatible storage endpoint (optional)",
+			EnvVar: "S3_ENDPOINT",
+		},
+		cli.BoolFlag{
+			Name:   "s3-path-style",
+			Usage:  "use path-style s3 addressing",
+			EnvVar: "S3_PATH_STYLE",
+		},
+		cli.BoolFlag{
+			Name:   "s3-disable-ssl",
+			Usage:  "connect to the s3 endpoint without tls",
+			EnvVar: "S3_DISABLE_SSL",
+		},
+		cli.StringFlag{
+			Name:   "s3-sse",
+			Usage:  "s3 server-side encryption, AES256 or aws:kms (optional)",
+			EnvVar: "S3_SSE",
+		},
+		cli.StringFlag{
+			Name:   "s3-storage-class",
+			Usage:  "s3 storage class (optional)",
+			EnvVar: "S3_STORAGE_CLASS",
+		},
+		cli.BoolFlag{
+			Name:   "s3-compress",
+			Usage:  "gzip compress logs uploaded to s3, which the 1.x server must be able to read",
+			EnvVar: "S3_COMPRESS",
+		},
+		cli.BoolFlag{
+			Name:   "s3-verify",
+			Usage:  "download each object uploaded to s3 and verify its size and checksums",
+			EnvVar: "S3_VERIFY",
+		},
+		cli.StringFlag{
+			Name:   "s3-manifest",
+			Usage:  "file to which the key and checksums of uploaded objects are appended (optional)",
+			EnvVar: "S3_MANIFEST",
+		},
+		cli.StringFlag{
+			Name:   "azure-account-name",
+			Usage:  "azure storage account name",
+			EnvVar: "AZURE_ACCOUNT_NAME",
+		},
+		cli.StringFlag{
+			Name:   "azure-account-key",
+			Usage:  "azure storage account key",
+			EnvVar: "AZURE_ACCOUNT_KEY",
+		},
+		cli.StringFlag{
+			Name:   "azure-container",
+			Usage:  "azure blob container name",
+			EnvVar: "AZURE_CONTAINER",
+		},
+		cli.StringFlag{
+			Name:   "azure-prefix",
+			Usage:  "azure blob name prefix (optional)",
+			EnvVar: "AZURE_PREFIX",
+		},
+		cli.StringFlag{
+			Name:   "azure-endpoint",
+			Usage:  "azure blob service endpoint (optional)",
+			EnvVar: "AZURE_ENDPOINT",
+		},
+		cli.StringFlag{
+			Name:   "log-dir",
+			Usage:  "directory to which logs are written by the file sink",
+			EnvVar: "LOG_DIR",
+		},
 		cli.Int64Flag{
 			Name:   "s3-resume",
-			Usage:  "resume uploading logs at this step id (optional)",
+			Usage:  "resume uploading logs after this step id, overriding the recorded progress (optional)",
 			EnvVar: "S3_RESUME",
 		},
+		cli.BoolFlag{
+			Name:   "dry-run",
+			Usage:  "convert and insert rows in a transaction that is always rolled back",
+			EnvVar: "DRY_RUN",
+		},
+		cli.IntFlag{
+			Name:   "page-size",
+			Usage:  "number of source rows read per query",
+			Value:  migrate.DefaultPageSize,
+			EnvVar: "PAGE_SIZE",
+		},
+		cli.IntFlag{
+			Name:   "batch-size",
+			Usage:  "number of rows inserted per transaction, or zero to run each step in a single transaction",
+			Value:  migrate.DefaultBatchSize,
+			EnvVar: "BATCH_SIZE",
+		},
+		cli.IntFlag{
+			Name:   "log-workers",
+			Usage:  "number of workers that concurrently fetch and upload logs",
+			Value:  migrate.DefaultLogWorkers,
+			EnvVar: "LOG_WORKERS",
+		},
+		cli.StringSliceFlag{
+			Name:   "step-batch-size",
+			Usage:  "override the batch size of a step, in the format step=size",
+			EnvVar: "STEP_BATCH_SIZE",
+		},
+		cli.StringFlag{
+			Name:   "on-conflict",
+			Usage:  "insert policy for rows that already exist in the 1.0 database, one of fail, skip or update",
+			Value:  string(migrate.ConflictFail),
+			EnvVar: "ON_CONFLICT",
+		},
+		cli.DurationFlag{
+			Name:   "progress-interval",
+			Usage:  "interval at which the progress of each migration step is logged, or a negative value to disable",
+			Value:  migrate.DefaultProgressInterval,
+			EnvVar: "PROGRESS_INTERVAL",
+		},
+		cli.StringFlag{
+			Name:   "metrics-addr",
+			Usage:  "address on which prometheus metrics are served at /metrics, for example :9100 (optional)",
+			EnvVar: "METRICS_ADDR",
+		},
+		cli.StringFlag{
+			Name:   "on-error",
+			Usage:  "policy for records that fail to migrate, one of abort, skip or quarantine (default: abort migration steps, skip repository updates)",
+			EnvVar: "ON_ERROR",
+		},
+		cli.StringSliceFlag{
+			Name:   "stage-labels",
+			Usage:  "stage environment variable migrated to the stage labels (repeatable, default: all variables)",
+			EnvVar: "STAGE_LABELS",
+		},
+		cli.StringFlag{
+			Name:   "report-json",
+			Usage:  "file to which the migration report is written in json format, or - for stdout (optional)",
+			EnvVar: "REPORT_JSON",
+		},
+		cli.StringFlag{
+			Name:   "report-markdown",
+			Usage:  "file to which the migration report is written in markdown format, or - for stdout (optional)",
+			EnvVar: "REPORT_MARKDOWN",
+		},
 		cli.BoolTFlag{
 			Name:   "debug",
 			Usage:  "enable debug mode",
@@ -126,6 +294,53 @@ func main() {
 		}
 		driver := c.GlobalString("target-database-driver")
 		setupDriver(driver)
+
+		var err error
+		batchSizes, err = parseBatchSizes(c.GlobalStringSlice("step-batch-size"))
+		if err != nil {
+			return err
+		}
+		onConflict, err = migrate.ParseConflictPolicy(c.GlobalString("on-conflict"))
+		if err != nil {
+			return err
+		}
+		onError, err = migrate.ParseErrorPolicy(c.GlobalString("on-error"))
+		if err != nil {
+			return err
+		}
+		if addr := c.GlobalString("metrics-addr"); addr != "" {
+			go serveMetrics(addr)
+		}
+		return nil
+	}
+
+	app.After = func(c *cli.Context) error {
+		if snapshot != nil {
+			if err := snapshot.Close(); err != nil {
+				logrus.WithError(err).Warnln("cannot close source database snapshot")
+			}
+		}
+		if len(report.Steps) == 0 {
+			return nil
+		}
+		if c.GlobalBool("dry-run") {
+			if err := report.WriteSummary(os.Stdout); err != nil {
+				return err
+			}
+		}
+		if path := c.GlobalString("report-json"); path != "" {
+			if err := writeReport(path, report.WriteJSON); err != nil {
+				return err
+			}
+		}
+		if path := c.GlobalString("report-markdown"); path != "" {
+			if err := writeReport(path, report.WriteMarkdown); err != nil {
+				return err
+			}
+		}
+		if n := report.Failed(); n != 0 {
+			return fmt.Errorf("%d records failed", n)
+		}
 		return nil
 	}
 
@@ -142,6 +357,14 @@ func main() {
 				logrus.Debugf("target database driver: %s", driver)
 				logrus.Debugf("target database datasource: %s", datasource)
 
+				// the schema cannot be created in a transaction
+				// that is rolled back, since mysql commits ddl
+				// statements immediately.
+				if c.GlobalBool("dry-run") {
+					logrus.Infoln("dry run: skip target database setup")
+					return nil
+				}
+
 				target, err := sql.Open(driver, datasource)
 
 				if err != nil {
@@ -162,10 +385,7 @@ func main() {
 			Name:  "migrate-users",
 			Usage: "migrate user resources",
 			Action: func(c *cli.Context) error {
-				source, err := sql.Open(
-					c.GlobalString("source-database-driver"),
-					c.GlobalString("source-database-datasource"),
-				)
+				source, err := openSource(c)
 
 				if err != nil {
 					return err
@@ -180,17 +400,14 @@ func main() {
 					return err
 				}
 
-				return migrate.MigrateUsers(source, target)
+				return migrate.MigrateUsers(source, target, options(c))
 			},
 		},
 		{
 			Name:  "migrate-repos",
 			Usage: "migrate repository resources",
 			Action: func(c *cli.Context) error {
-				source, err := sql.Open(
-					c.GlobalString("source-database-driver"),
-					c.GlobalString("source-database-datasource"),
-				)
+				source, err := openSource(c)
 
 				if err != nil {
 					return err
@@ -205,7 +422,7 @@ func main() {
 					return err
 				}
 
-				return migrate.MigrateRepos(source, target)
+				return migrate.MigrateRepos(source, target, options(c))
 			},
 		},
 		{
@@ -236,7 +453,38 @@ func main() {
 					return err
 				}
 
-				return migrate.UpdateRepoIdentifiers(target, client)
+				return migrate.UpdateRepoIdentifiers(target, client, options(c))
+			},
+		},
+		{
+			Name:  "merge-renamed",
+			Usage: "merge renamed repositories",
+			Action: func(c *cli.Context) error {
+				var (
+					driver     = c.GlobalString("target-database-driver")
+					datasource = c.GlobalString("target-database-datasource")
+					provider   = c.GlobalString("scm-driver")
+					server     = c.GlobalString("scm-server")
+				)
+
+				logrus.Debugf("target database driver: %s", driver)
+				logrus.Debugf("target database datasource: %s", datasource)
+				logrus.Debugf("scm driver: %s", provider)
+				logrus.Debugf("scm server: %s", server)
+
+				target, err := sql.Open(driver, datasource)
+
+				if err != nil {
+					return err
+				}
+
+				client, err := createClient(c)
+
+				if err != nil {
+					return err
+				}
+
+				return migrate.MergeRenamed(target, client, options(c))
 			},
 		},
 		{
@@ -267,7 +515,7 @@ func main() {
 					return err
 				}
 
-				return migrate.RemoveRenamed(target, client)
+				return migrate.RemoveRenamed(target, client, options(c))
 			},
 		},
 		{
@@ -298,17 +546,14 @@ func main() {
 					return err
 				}
 
-				return migrate.RemoveNotFound(target, client)
+				return migrate.RemoveNotFound(target, client, options(c))
 			},
 		},
 		{
 			Name:  "migrate-builds",
 			Usage: "migrate drone builds",
 			Action: func(c *cli.Context) error {
-				source, err := sql.Open(
-					c.GlobalString("source-database-driver"),
-					c.GlobalString("source-database-datasource"),
-				)
+				source, err := openSource(c)
 
 				if err != nil {
 					return err
@@ -323,7 +568,7 @@ func main() {
 					return err
 				}
 
-				return migrate.MigrateBuilds(source, target)
+				return migrate.MigrateBuilds(source, target, options(c))
 			},
 		},
 
@@ -331,10 +576,7 @@ func main() {
 			Name:  "migrate-stages",
 			Usage: "migrate drone stages",
 			Action: func(c *cli.Context) error {
-				source, err := sql.Open(
-					c.GlobalString("source-database-driver"),
-					c.GlobalString("source-database-datasource"),
-				)
+				source, err := openSource(c)
 
 				if err != nil {
 					return err
@@ -349,17 +591,14 @@ func main() {
 					return err
 				}
 
-				return migrate.MigrateStages(source, target)
+				return migrate.MigrateStages(source, target, options(c))
 			},
 		},
 		{
 			Name:  "migrate-steps",
 			Usage: "migrate drone steps",
 			Action: func(c *cli.Context) error {
-				source, err := sql.Open(
-					c.GlobalString("source-database-driver"),
-					c.GlobalString("source-database-datasource"),
-				)
+				source, err := openSource(c)
 
 				if err != nil {
 					return err
@@ -374,17 +613,17 @@ func main() {
 					return err
 				}
 
-				return migrate.MigrateSteps(source, target)
+				return migrate.MigrateSteps(source, target, options(c))
 			},
 		},
 		{
 			Name:  "migrate-logs",
 			Usage: "migrate drone logs",
+			Flags: []cli.Flag{
+				sinkFlag,
+			},
 			Action: func(c *cli.Context) error {
-				source, err := sql.Open(
-					c.GlobalString("source-database-driver"),
-					c.GlobalString("source-database-datasource"),
-				)
+				source, err := openSource(c)
 
 				if err != nil {
 					return err
@@ -399,36 +638,88 @@ func main() {
 					return err
 				}
 
-				return migrate.MigrateLogs(source, target)
+				sink, err := createLogSink(c, c.String("sink"), target)
+
+				if err != nil {
+					return err
+				}
+
+				return migrate.MigrateLogs(source, target, sink, options(c))
 			},
 		},
 		{
 			Name:  "migrate-logs-s3",
-			Usage: "migrate drone logs to s3",
+			Usage: "migrate drone logs to s3 (alias for migrate-logs --sink=s3)",
+			Action: func(c *cli.Context) error {
+				source, err := openSource(c)
+
+				if err != nil {
+					return err
+				}
+
+				target, err := sql.Open(
+					c.GlobalString("target-database-driver"),
+					c.GlobalString("target-database-datasource"),
+				)
+
+				if err != nil {
+					return err
+				}
+
+				sink, err := createLogSink(c, "s3", target)
+
+				if err != nil {
+					return err
+				}
+
+				opts := options(c)
+				opts.ResumeLogs = c.GlobalInt64("s3-resume")
+				return migrate.MigrateLogs(source, target, sink, opts)
+			},
+		},
+		{
+			Name:  "offload-logs",
+			Usage: "move drone logs from the 1.x database to s3",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:   "sink",
+					Usage:  "log sink, one of s3, azure or file",
+					Value:  "s3",
+					EnvVar: "LOG_SINK",
+				},
+				cli.BoolFlag{
+					Name:  "keep-rows",
+					Usage: "set the log data to null instead of deleting the row",
+				},
+			},
 			Action: func(c *cli.Context) error {
-				source, err := sql.Open(
-					c.GlobalString("source-database-driver"),
-					c.GlobalString("source-database-datasource"),
+				if c.String("sink") == "db" {
+					return errors.New("cannot offload logs to the database sink")
+				}
+
+				target, err := sql.Open(
+					c.GlobalString("target-database-driver"),
+					c.GlobalString("target-database-datasource"),
 				)
 
 				if err != nil {
 					return err
 				}
 
-				resume := c.GlobalInt64("s3-resume")
-				bucket := c.GlobalString("s3-bucket")
-				prefix := c.GlobalString("s3-prefix")
-				return migrate.MigrateLogsS3(source, bucket, prefix, resume)
+				sink, err := createLogSink(c, c.String("sink"), target)
+
+				if err != nil {
+					return err
+				}
+
+				return migrate.OffloadLogs(target, sink, c.Bool("keep-rows"), options(c))
 			},
 		},
 		{
 			Name:  "migrate-secrets",
 			Usage: "migrate drone secrets",
 			Action: func(c *cli.Context) error {
-				source, err := sql.Open(
-					c.GlobalString("source-database-driver"),
-					c.GlobalString("source-database-datasource"),
-				)
+				source, err := openSource(c)
 
 				if err != nil {
 					return err
@@ -443,17 +734,14 @@ func main() {
 					return err
 				}
 
-				return migrate.MigrateSecrets(source, target)
+				return migrate.MigrateSecrets(source, target, options(c))
 			},
 		},
 		{
 			Name:  "migrate-registries",
 			Usage: "migrate registry credentials",
 			Action: func(c *cli.Context) error {
-				source, err := sql.Open(
-					c.GlobalString("source-database-driver"),
-					c.GlobalString("source-database-datasource"),
-				)
+				source, err := openSource(c)
 
 				if err != nil {
 					return err
@@ -468,7 +756,7 @@ func main() {
 					return err
 				}
 
-				return migrate.MigrateRegistries(source, target)
+				return migrate.MigrateRegistries(source, target, options(c))
 			},
 		},
 		{
@@ -487,6 +775,7 @@ func main() {
 				return migrate.ActivateRepositories(
 					target,
 					drone.New(c.GlobalString("drone-server")),
+					options(c),
 				)
 			},
 		},
@@ -506,6 +795,7 @@ func main() {
 				return migrate.EncryptSecrets(
 					target,
 					c.GlobalString("target-database-encryption-key"),
+					options(c),
 				)
 			},
 		},
@@ -513,10 +803,7 @@ func main() {
 			Name:  "dump-tokens",
 			Usage: "dump user tokens to stdout",
 			Action: func(c *cli.Context) error {
-				source, err := sql.Open(
-					c.GlobalString("source-database-driver"),
-					c.GlobalString("source-database-datasource"),
-				)
+				source, err := openSource(c)
 
 				if err != nil {
 					return err
@@ -525,6 +812,388 @@ func main() {
 				return migrate.DumpTokens(source, os.Stdout)
 			},
 		},
+		{
+			Name:  "preflight",
+			Usage: "detect 0.8 data that will be rejected by the 1.0 database",
+			Action: func(c *cli.Context) error {
+				driver := c.GlobalString("source-database-driver")
+				source, err := openSource(c)
+
+				if err != nil {
+					return err
+				}
+
+				issues, err := migrate.Preflight(source, driver, options(c))
+
+				if err != nil {
+					return err
+				}
+
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				if err := enc.Encode(issues); err != nil {
+					return err
+				}
+
+				var rejected int
+				for _, issue := range issues {
+					if !issue.Warning {
+						rejected++
+					}
+				}
+				if rejected != 0 {
+					return fmt.Errorf("preflight found %d issues", rejected)
+				}
+
+				logrus.Infoln("preflight complete, no issues found")
+				return nil
+			},
+		},
+		{
+			Name:  "verify",
+			Usage: "compare the 0.8 database with the 1.0 database",
+			Flags: []cli.Flag{
+				cli.StringSliceFlag{
+					Name:  "skip",
+					Usage: "skip the named entity, such as logs",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				source, err := openSource(c)
+
+				if err != nil {
+					return err
+				}
+
+				target, err := sql.Open(
+					c.GlobalString("target-database-driver"),
+					c.GlobalString("target-database-datasource"),
+				)
+
+				if err != nil {
+					return err
+				}
+
+				result, err := migrate.Verify(source, target, c.StringSlice("skip"), options(c))
+
+				if err != nil {
+					return err
+				}
+
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				if err := enc.Encode(result); err != nil {
+					return err
+				}
+
+				if len(result.Differences) != 0 {
+					return fmt.Errorf("verify found %d differences", len(result.Differences))
+				}
+
+				logrus.Infoln("verify complete, no differences found")
+				return nil
+			},
+		},
+		{
+			Name:  "check-target",
+			Usage: "detect rows in the 1.0 database that violate referential integrity",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "repair",
+					Usage: "repair the issues that can be fixed mechanically",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				target, err := sql.Open(
+					c.GlobalString("target-database-driver"),
+					c.GlobalString("target-database-datasource"),
+				)
+
+				if err != nil {
+					return err
+				}
+
+				repair := c.Bool("repair") && !c.GlobalBool("dry-run")
+				issues, err := migrate.CheckTarget(target, repair)
+
+				if err != nil {
+					return err
+				}
+
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				if err := enc.Encode(issues); err != nil {
+					return err
+				}
+
+				var remaining int
+				for _, issue := range issues {
+					if !issue.Repaired {
+						remaining++
+					}
+				}
+				if remaining != 0 {
+					return fmt.Errorf("check-target found %d issues", remaining)
+				}
+
+				logrus.Infoln("check-target complete, no issues found")
+				return nil
+			},
+		},
+		{
+			Name:  "status",
+			Usage: "print the progress of each migration step",
+			Action: func(c *cli.Context) error {
+				target, err := sql.Open(
+					c.GlobalString("target-database-driver"),
+					c.GlobalString("target-database-datasource"),
+				)
+
+				if err != nil {
+					return err
+				}
+
+				ledgers, err := migrate.ListLedger(target)
+
+				if err != nil {
+					return err
+				}
+
+				watermarks, err := migrate.ListWatermarks(target)
+
+				if err != nil {
+					return err
+				}
+
+				marks := map[string]int64{}
+				for _, watermark := range watermarks {
+					marks[watermark.Step] = watermark.Value
+				}
+
+				w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+				fmt.Fprintln(w, "STEP\tSTATUS\tROWS\tLAST ID\tWATERMARK\tSTARTED\tFINISHED\tERROR")
+				for _, ledger := range ledgers {
+					fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\t%s\t%s\t%s\n",
+						ledger.Step,
+						ledger.Status,
+						ledger.Rows,
+						ledger.LastID,
+						formatUnix(marks[ledger.Step]),
+						formatUnix(ledger.Started),
+						formatUnix(ledger.Finished),
+						ledger.Error,
+					)
+				}
+				return w.Flush()
+			},
+		},
+		{
+			Name:      "reset",
+			Usage:     "reset the progress of a migration step",
+			ArgsUsage: "<step>...",
+			Action: func(c *cli.Context) error {
+				if c.GlobalBool("dry-run") {
+					return errors.New("cannot reset migration steps in dry run mode")
+				}
+
+				target, err := sql.Open(
+					c.GlobalString("target-database-driver"),
+					c.GlobalString("target-database-datasource"),
+				)
+
+				if err != nil {
+					return err
+				}
+
+				for _, step := range c.Args() {
+					if err := migrate.ResetLedger(target, step); err != nil {
+						return err
+					}
+					logrus.WithField("step", step).Infoln("migration step reset")
+				}
+				return nil
+			},
+		},
+		{
+			Name:  "list-failed",
+			Usage: "print the records that failed to migrate",
+			Action: func(c *cli.Context) error {
+				target, err := sql.Open(
+					c.GlobalString("target-database-driver"),
+					c.GlobalString("target-database-datasource"),
+				)
+
+				if err != nil {
+					return err
+				}
+
+				failures, err := migrate.ListFailures(target)
+
+				if err != nil {
+					return err
+				}
+
+				w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+				fmt.Fprintln(w, "STEP\tENTITY\tID\tSTATUS\tATTEMPTS\tUPDATED\tERROR")
+				for _, failure := range failures {
+					fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%d\t%s\t%s\n",
+						failure.Step,
+						failure.Entity,
+						failure.ID,
+						failure.Status,
+						failure.Attempts,
+						formatUnix(failure.Updated),
+						strings.ReplaceAll(failure.Error, "\n", " "),
+					)
+				}
+				return w.Flush()
+			},
+		},
+		{
+			Name:      "retry-failed",
+			Usage:     "retry the records that failed to migrate",
+			ArgsUsage: "[<step>...]",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "quarantined",
+					Usage: "also retry quarantined records",
+				},
+				sinkFlag,
+			},
+			Action: func(c *cli.Context) error {
+				target, err := sql.Open(
+					c.GlobalString("target-database-driver"),
+					c.GlobalString("target-database-datasource"),
+				)
+
+				if err != nil {
+					return err
+				}
+
+				failures, err := migrate.ListFailures(target)
+
+				if err != nil {
+					return err
+				}
+
+				steps, ids := selectFailures(failures, c.Args(), c.Bool("quarantined"))
+				if len(steps) == 0 {
+					logrus.Infoln("no failed records to retry")
+					return nil
+				}
+
+				var failed int
+				for _, step := range steps {
+					log := logrus.WithField("step", step)
+
+					name, sink := retryCommand(step)
+					command := c.App.Command(name)
+					if command == nil {
+						log.Warnln("cannot retry unknown migration step")
+						continue
+					}
+					if sink != "" {
+						if err := c.Set("sink", sink); err != nil {
+							return err
+						}
+					}
+
+					log.Infof("retrying %d failed records", len(ids[step]))
+					retryIDs = ids[step]
+					err := cli.HandleAction(command.Action, c)
+					retryIDs = nil
+
+					if err != nil {
+						log.WithError(err).Errorln("retry failed")
+						failed++
+					}
+				}
+
+				if failed != 0 {
+					return fmt.Errorf("%d migration steps failed", failed)
+				}
+				return nil
+			},
+		},
+		{
+			Name:  "migrate-all",
+			Usage: "run the full migration pipeline in order",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "from",
+					Usage: "start the pipeline at this step",
+				},
+				cli.StringFlag{
+					Name:  "until",
+					Usage: "stop the pipeline after this step",
+				},
+				sinkFlag,
+				cli.StringSliceFlag{
+					Name:  "skip",
+					Usage: "skip this step (repeatable)",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				steps, err := selectSteps(
+					pipeline,
+					c.String("from"),
+					c.String("until"),
+					c.StringSlice("skip"),
+				)
+
+				if err != nil {
+					return err
+				}
+
+				for _, name := range steps {
+					log := logrus.WithField("step", name)
+					log.Infoln("begin migration step")
+
+					command := c.App.Command(name)
+					if err := cli.HandleAction(command.Action, c); err != nil {
+						log.WithError(err).Errorf("migration step failed, resume with: migrate-all --from=%s", name)
+						return err
+					}
+
+					log.Infoln("migration step complete")
+				}
+
+				logrus.Infoln("migration pipeline complete")
+				return nil
+			},
+		},
+		{
+			Name:  "sync",
+			Usage: "sync the rows created or changed since the previous run",
+			Flags: []cli.Flag{
+				sinkFlag,
+			},
+			Action: func(c *cli.Context) error {
+				// synced rows replace the existing rows, so the
+				// conflict policy cannot be configured.
+				if c.GlobalIsSet("on-conflict") && onConflict != migrate.ConflictUpdate {
+					return fmt.Errorf("cannot sync with on-conflict %s, synced rows are always updated", onConflict)
+				}
+				syncing = true
+				defer func() { syncing = false }()
+
+				for _, name := range syncPipeline {
+					log := logrus.WithField("step", name)
+					log.Infoln("begin sync step")
+
+					command := c.App.Command(name)
+					if err := cli.HandleAction(command.Action, c); err != nil {
+						log.WithError(err).Errorln("sync step failed, resume with: sync")
+						return err
+					}
+
+					log.Infoln("sync step complete")
+				}
+
+				logrus.Infoln("sync complete")
+				return nil
+			},
+		},
 	}
 
 	if err := app.Run(os.Args); err != nil {
@@ -532,16 +1201,350 @@ func main() {
 	}
 }
 
+// pipeline lists the commands executed by migrate-all, in
+// the order required by the dependencies between them.
+var pipeline = []string{
+	"setup-database",
+	"migrate-users",
+	"migrate-repos",
+	"migrate-secrets",
+	"migrate-registries",
+	"migrate-builds",
+	"migrate-stages",
+	"migrate-steps",
+	"migrate-logs",
+	"update-repos",
+	"merge-renamed",
+	"remove-renamed",
+	"remove-not-found",
+}
+
+// syncPipeline lists the commands executed by sync, in the
+// order required by the dependencies between them. The steps
+// that update repositories in the remote system are executed
+// once, after the final sync.
+var syncPipeline = []string{
+	"migrate-users",
+	"migrate-repos",
+	"migrate-secrets",
+	"migrate-registries",
+	"migrate-builds",
+	"migrate-stages",
+	"migrate-steps",
+	"migrate-logs",
+}
+
+// selectSteps returns the pipeline steps between from and
+// until (inclusive), excluding any skipped steps. An empty
+// from or until selects the first or last step respectively.
+func selectSteps(steps []string, from, until string, skip []string) ([]string, error) {
+	index := func(name string) (int, error) {
+		for i, step := range steps {
+			if step == name {
+				return i, nil
+			}
+		}
+		return -1, fmt.Errorf("unknown migration step: %s", name)
+	}
+
+	start, end := 0, len(steps)-1
+	if from != "" {
+		i, err := index(from)
+		if err != nil {
+			return nil, err
+		}
+		start = i
+	}
+	if until != "" {
+		i, err := index(until)
+		if err != nil {
+			return nil, err
+		}
+		end = i
+	}
+	if start > end {
+		return nil, fmt.Errorf("migration step %s runs after %s", from, until)
+	}
+
+	skipped := map[string]bool{}
+	for _, name := range skip {
+		if _, err := index(name); err != nil {
+			return nil, err
+		}
+		skipped[name] = true
+	}
+
+	var selected []string
+	for _, step := range steps[start : end+1] {
+		if !skipped[step] {
+			selected = append(selected, step)
+		}
+	}
+	return selected, nil
+}
+
+// report collects the summary of the migration steps executed
+// by the current command.
+var report = new(migrate.Report)
+
+// writeReport writes the report to the named file, or to
+// stdout if the path is -.
+func writeReport(path string, write func(io.Writer) error) error {
+	if path == "-" {
+		return write(os.Stdout)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// options returns the migration options configured by the
+// global command line flags.
+func options(c *cli.Context) migrate.Options {
+	opts := migrate.Options{
+		DryRun:           c.GlobalBool("dry-run"),
+		Report:           report,
+		PageSize:         c.GlobalInt("page-size"),
+		BatchSize:        c.GlobalInt("batch-size"),
+		StepBatchSize:    batchSizes,
+		LogWorkers:       c.GlobalInt("log-workers"),
+		OnConflict:       onConflict,
+		OnError:          onError,
+		Retry:            retryIDs,
+		EncryptionKey:    c.GlobalString("target-database-encryption-key"),
+		StageLabels:      c.GlobalStringSlice("stage-labels"),
+		Sync:             syncing,
+		ProgressInterval: c.GlobalDuration("progress-interval"),
+		Throttle: migrate.Throttle{
+			RowsPerSecond:    c.GlobalFloat64("source-rows-per-second"),
+			QueriesPerSecond: c.GlobalFloat64("source-queries-per-second"),
+			MaxLatency:       c.GlobalDuration("source-max-latency"),
+		},
+	}
+	// synced rows replace the existing rows, which includes
+	// the logs written to the database.
+	if syncing {
+		opts.OnConflict = migrate.ConflictUpdate
+	}
+	return opts
+}
+
+// serveMetrics serves the prometheus metrics on the address.
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", migrate.MetricsHandler())
+
+	logrus.WithField("addr", addr).Infoln("serving metrics")
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		logrus.WithError(err).Errorln("cannot serve metrics")
+	}
+}
+
+// snapshot holds the source database snapshot, which is taken
+// when the source database is first opened, and shared by the
+// migration steps of the command.
+var snapshot *migrate.Snapshot
+
+// openSource opens the source database, or returns the source
+// database snapshot if enabled. The source database is read
+// from the replica if configured.
+func openSource(c *cli.Context) (*sql.DB, error) {
+	var (
+		driver     = c.GlobalString("source-database-driver")
+		datasource = c.GlobalString("source-database-datasource")
+	)
+	if replica := c.GlobalString("source-database-replica"); replica != "" {
+		logrus.Debugln("reading source database from replica")
+		datasource = replica
+	}
+	if !c.GlobalBool("source-snapshot") {
+		return migrate.OpenSource(driver, datasource, options(c))
+	}
+	if snapshot == nil {
+		s, err := migrate.OpenSnapshot(driver, datasource, options(c))
+		if err != nil {
+			return nil, err
+		}
+		snapshot = s
+	}
+	return snapshot.DB, nil
+}
+
+// onError holds the error policy parsed from the on-error
+// flag.
+var onError migrate.ErrorPolicy
+
+// retryIDs holds the identifiers of the failed records that
+// are retried by the current migration step.
+var retryIDs []int64
+
+// syncing is true while the migration steps are executed by
+// the sync command.
+var syncing bool
+
+// retryCommand returns the command, and the log sink, that
+// retries the failed records of the migration step.
+func retryCommand(step string) (string, string) {
+	switch {
+	case step == "migrate-logs":
+		return "migrate-logs", "db"
+	case strings.HasPrefix(step, "migrate-logs-"):
+		return "migrate-logs", strings.TrimPrefix(step, "migrate-logs-")
+	default:
+		return step, ""
+	}
+}
+
+// selectFailures groups the identifiers of the failed records
+// by migration step, optionally limited to the named steps.
+// The steps are returned in pipeline order.
+func selectFailures(failures []*migrate.Failure, names []string, quarantined bool) ([]string, map[string][]int64) {
+	selected := map[string]bool{}
+	for _, name := range names {
+		selected[name] = true
+	}
+
+	var steps []string
+	ids := map[string][]int64{}
+	for _, failure := range failures {
+		if len(selected) != 0 && !selected[failure.Step] {
+			continue
+		}
+		if failure.Status == migrate.FailureQuarantined && !quarantined {
+			continue
+		}
+		if _, ok := ids[failure.Step]; !ok {
+			steps = append(steps, failure.Step)
+		}
+		ids[failure.Step] = append(ids[failure.Step], failure.ID)
+	}
+
+	index := func(step string) int {
+		command, _ := retryCommand(step)
+		for i, name := range pipeline {
+			if name == command {
+				return i
+			}
+		}
+		return len(pipeline)
+	}
+	sort.SliceStable(steps, func(i, j int) bool {
+		return index(steps[i]) < index(steps[j])
+	})
+	return steps, ids
+}
+
+// onConflict holds the conflict policy parsed from the
+// on-conflict flag.
+var onConflict migrate.ConflictPolicy
+
+// batchSizes holds the per-step batch sizes parsed from the
+// step-batch-size flag.
+var batchSizes map[string]int
+
+// parseBatchSizes parses a list of step=size pairs.
+func parseBatchSizes(values []string) (map[string]int, error) {
+	sizes := map[string]int{}
+	for _, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid step batch size: %s", value)
+		}
+		size, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid step batch size: %s", value)
+		}
+		sizes[parts[0]] = size
+	}
+	return sizes, nil
+}
+
+// formatUnix formats a unix timestamp for display, returning
+// an empty string if the timestamp is not set.
+func formatUnix(t int64) string {
+	if t == 0 {
+		return ""
+	}
+	return time.Unix(t, 0).Format(time.RFC3339)
+}
+
 func setupDriver(driver string) {
 	switch driver {
 	case "postgres":
 		meddler.Default = meddler.PostgreSQL
 	case "mysql":
 		meddler.Default = meddler.MySQL
+	case "sqlite3":
+		meddler.Default = meddler.SQLite
+	}
+}
+
+// sinkFlag selects the log sink of the migrate-logs command.
+var sinkFlag = cli.StringFlag{
+	Name:   "sink",
+	Usage:  "log sink, one of db, s3, azure or file",
+	Value:  "db",
+	EnvVar: "LOG_SINK",
+}
+
+// createLogSink creates the named log sink.
+func createLogSink(c *cli.Context, name string, target *sql.DB) (migrate.LogSink, error) {
+	switch name {
+	case "db":
+		opts := options(c)
+		return migrate.NewDatabaseSink(target, opts.OnConflict, opts.OnError), nil
+	case "s3":
+		return migrate.NewS3Sink(migrate.S3Config{
+			Bucket:       c.GlobalString("s3-bucket"),
+			Prefix:       c.GlobalString("s3-prefix"),
+			Endpoint:     c.GlobalString("s3-endpoint"),
+			PathStyle:    c.GlobalBool("s3-path-style"),
+			DisableSSL:   c.GlobalBool("s3-disable-ssl"),
+			Encryption:   c.GlobalString("s3-sse"),
+			StorageClass: c.GlobalString("s3-storage-class"),
+			Compress:     c.GlobalBool("s3-compress"),
+			Verify:       c.GlobalBool("s3-verify"),
+			Manifest:     c.GlobalString("s3-manifest"),
+		})
+	case "azure":
+		return migrate.NewAzureSink(migrate.AzureConfig{
+			AccountName: c.GlobalString("azure-account-name"),
+			AccountKey:  c.GlobalString("azure-account-key"),
+			Container:   c.GlobalString("azure-container"),
+			Prefix:      c.GlobalString("azure-prefix"),
+			Endpoint:    c.GlobalString("azure-endpoint"),
+		})
+	case "file":
+		dir := c.GlobalString("log-dir")
+		if dir == "" {
+			return nil, errors.New("log-dir is required by the file sink")
+		}
+		return migrate.NewFileSink(dir), nil
+	default:
+		return nil, fmt.Errorf("unknown log sink: %s", name)
 	}
 }
 
 func createClient(c *cli.Context) (*scm.Client, error) {
+	client, err := createDriverClient(c)
+	if err != nil {
+		return nil, err
+	}
+	// the transport is instrumented to count the requests
+	// to the source code management system.
+	client.Client.Transport = migrate.InstrumentTransport(client.Client.Transport)
+	return client, nil
+}
+
+// createDriverClient creates the client of the configured
+// source code management system.
+func createDriverClient(c *cli.Context) (*scm.Client, error) {
 	server := c.GlobalString("scm-server")
 
 	switch c.GlobalString("scm-driver") {
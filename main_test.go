@@ -0,0 +1,74 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSelectSteps(t *testing.T) {
+	steps := []string{"a", "b", "c", "d"}
+	tests := []struct {
+		from, until string
+		skip        []string
+		want        []string
+		err         bool
+	}{
+		{want: []string{"a", "b", "c", "d"}},
+		{from: "b", want: []string{"b", "c", "d"}},
+		{until: "c", want: []string{"a", "b", "c"}},
+		{from: "b", until: "c", want: []string{"b", "c"}},
+		{from: "c", until: "c", want: []string{"c"}},
+		{skip: []string{"a", "c"}, want: []string{"b", "d"}},
+		{from: "b", until: "c", skip: []string{"b", "c"}, want: nil},
+		{from: "d", until: "a", err: true},
+		{from: "x", err: true},
+		{until: "x", err: true},
+		{skip: []string{"x"}, err: true},
+	}
+	for _, test := range tests {
+		got, err := selectSteps(steps, test.from, test.until, test.skip)
+		if test.err {
+			if err == nil {
+				t.Errorf("from %q until %q skip %v: want error", test.from, test.until, test.skip)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("from %q until %q skip %v: %s", test.from, test.until, test.skip, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("from %q until %q skip %v: want %v, got %v", test.from, test.until, test.skip, test.want, got)
+		}
+	}
+}
+
+func TestParseBatchSizes(t *testing.T) {
+	tests := []struct {
+		values []string
+		want   map[string]int
+		err    bool
+	}{
+		{values: nil, want: map[string]int{}},
+		{values: []string{"migrate-logs=100"}, want: map[string]int{"migrate-logs": 100}},
+		{values: []string{"migrate-logs=100", "migrate-steps=0"}, want: map[string]int{"migrate-logs": 100, "migrate-steps": 0}},
+		{values: []string{"migrate-logs"}, err: true},
+		{values: []string{"migrate-logs=ten"}, err: true},
+	}
+	for _, test := range tests {
+		got, err := parseBatchSizes(test.values)
+		if test.err {
+			if err == nil {
+				t.Errorf("%v: want error", test.values)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %s", test.values, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v: want %v, got %v", test.values, test.want, got)
+		}
+	}
+}
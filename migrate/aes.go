@@ -11,6 +11,13 @@ import (
 // indicates key size is too small.
 var errKeySize = errors.New("encryption key must be 32 bytes")
 
+// indicates the secrets are encrypted, and the encryption key
+// is required to migrate secrets.
+var errEncryptionKey = errors.New("secrets are encrypted, the target database encryption key is required")
+
+// indicates the secrets are already encrypted.
+var errSecretsEncrypted = errors.New("secrets are already encrypted")
+
 // helper function parses the encryption key.
 func parseKey(key string) (cipher.Block, error) {
 	if len(key) != 32 {
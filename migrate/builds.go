@@ -2,40 +2,44 @@ package migrate
 
 import (
 	"database/sql"
-	"fmt"
 
-	"github.com/russross/meddler"
 	"github.com/sirupsen/logrus"
 )
 
 // MigrateBuilds migrates the builds from the V0
 // database to the V1 database.
-func MigrateBuilds(source, target *sql.DB) error {
-	buildsV0 := []*BuildV0{}
-
-	// 1. load all repos from the V0 database.
-	err := meddler.QueryAll(source, &buildsV0, "select * from builds")
+func MigrateBuilds(source, target *sql.DB, opts Options) (err error) {
+	task, err := beginTask(target, "migrate-builds", opts)
 	if err != nil {
 		return err
 	}
+	defer func() { task.end(err) }()
 
-	logrus.Infof("migrating %d builds", len(buildsV0))
+	logrus.Infoln("migrating builds")
+	task.count(source, buildCountQuery)
+	if err := task.mark(source, buildWatermarkQuery); err != nil {
+		return err
+	}
 
-	// 2. create a database transaction so that we
+	// 1. create a database transaction so that we
 	// can rollback if the data migration fails.
-	tx, err := target.Begin()
-	if err != nil {
+	if err := task.begin(); err != nil {
 		return err
 	}
-	defer tx.Rollback()
-
-	// 3. iterate through the list and convert from
-	// the 0.x to the 1.x structure and insert.
-	var sequence int64
-	for _, buildV0 := range buildsV0 {
-		if buildV0.ID > sequence {
-			sequence = buildV0.ID
+
+	// 2. iterate through the V0 builds one page at a
+	// time, convert from the 0.x to the 1.x structure
+	// and insert.
+	migrate := func(rows *sql.Rows) (int64, error) {
+		buildV0 := &BuildV0{}
+		if err := scanRow(rows, buildV0); err != nil {
+			return 0, err
+		}
+		if !task.selected(buildV0.ID) {
+			return buildV0.ID, nil
 		}
+		task.report.Read++
+		task.track(buildV0.ID)
 
 		log := logrus.
 			WithField("repository", buildV0.RepoID).
@@ -77,15 +81,18 @@ func MigrateBuilds(source, target *sql.DB) error {
 		}
 		if len(buildV1.Message) > 1000 {
 			buildV1.Message = buildV1.Message[:1000]
+			task.warn(log, "build message truncated")
 		}
 		if len(buildV1.Title) > 1000 {
 			buildV1.Title = buildV1.Title[:1000]
+			task.warn(log, "build title truncated")
 		}
 
-		err = meddler.Insert(tx, "builds", buildV1)
-		if err != nil {
-			log.WithError(err).Errorln("migration failed")
-			return err
+		if err := task.insert("builds", buildV0.ID, buildV1, log); err != nil {
+			return 0, err
+		}
+		if err := task.progress(buildV0.ID); err != nil {
+			return 0, err
 		}
 
 		//
@@ -93,20 +100,66 @@ func MigrateBuilds(source, target *sql.DB) error {
 		//
 
 		log.Debugln("build migration complete")
+		return buildV0.ID, nil
 	}
 
-	if meddler.Default == meddler.PostgreSQL {
-		_, err = tx.Exec(fmt.Sprintf(updateBuildSeq, sequence+1))
-		if err != nil {
-			logrus.WithError(err).Errorln("failed to reset sequence")
-			return err
-		}
+	// 3. when the step is synced, migrate the builds that were
+	// running or completed since the previous run, and then
+	// the new builds.
+	if err := task.changed(source, buildChangedQuery, buildChangedCountQuery, migrate); err != nil {
+		return err
+	}
+	err = paginate(source, buildImportQuery, task.ledger.LastID, opts.pageSize(), migrate)
+	if err != nil {
+		return err
 	}
 
+	if err := task.resetSequence(updateBuildSeq); err != nil {
+		return err
+	}
+
+	logrus.Infof("migrated %d builds", task.report.Inserted)
 	logrus.Infof("migration complete")
-	return tx.Commit()
+	return task.commit()
 }
 
+const buildImportQuery = `
+SELECT *
+FROM builds
+WHERE build_id > %d
+ORDER BY build_id
+LIMIT %d
+`
+
+const buildCountQuery = `
+SELECT COUNT(*)
+FROM builds
+WHERE build_id > %d
+`
+
+const buildChangedQuery = `
+SELECT *
+FROM builds
+WHERE build_id > %%d
+  AND build_id <= %d
+  AND (build_finished = 0 OR build_finished > %d)
+ORDER BY build_id
+LIMIT %%d
+`
+
+const buildChangedCountQuery = `
+SELECT COUNT(*)
+FROM builds
+WHERE build_id > %%d
+  AND build_id <= %d
+  AND (build_finished = 0 OR build_finished > %d)
+`
+
+const buildWatermarkQuery = `
+SELECT COALESCE(MAX(build_finished), 0)
+FROM builds
+`
+
 const buildListQuery = `
 SELECT builds.*
 FROM builds INNER JOIN repos ON build.build_repo_id = repos.repo_id
@@ -114,6 +167,7 @@ WHERE repos.repo_user_id > 0
 `
 
 const updateBuildSeq = `
-ALTER SEQUENCE builds_build_id_seq
-RESTART WITH %d
+SELECT setval('builds_build_id_seq', GREATEST(%d
+  ,(SELECT MAX(build_id) FROM builds)
+  ,(SELECT last_value FROM builds_build_id_seq)))
 `
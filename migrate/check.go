@@ -0,0 +1,415 @@
+package migrate
+
+import (
+	"database/sql"
+
+	"github.com/sirupsen/logrus"
+)
+
+// targetCheck defines a query that returns the identifier and
+// offending value of each row in the V1 database that fails
+// the check, and an optional statement that repairs all rows
+// that fail the check.
+type targetCheck struct {
+	preflightCheck
+	repair string
+}
+
+// targetChecks lists the V1 database checks. Checks are run in
+// order, so that rows orphaned by the repair of a previous
+// check, such as the stages of a deleted build, are found by
+// the subsequent checks.
+var targetChecks = []targetCheck{
+	{
+		preflightCheck: preflightCheck{
+			name:    "orphaned-build",
+			table:   "builds",
+			column:  "build_repo_id",
+			query:   checkBuildRepoQuery,
+			message: "repository does not exist",
+			fix:     "delete the build",
+		},
+		repair: repairBuildRepoStmt,
+	},
+	{
+		preflightCheck: preflightCheck{
+			name:    "orphaned-stage",
+			table:   "stages",
+			column:  "stage_build_id",
+			query:   checkStageBuildQuery,
+			message: "build does not exist",
+			fix:     "delete the stage",
+		},
+		repair: repairStageBuildStmt,
+	},
+	{
+		preflightCheck: preflightCheck{
+			name:    "stage-repo",
+			table:   "stages",
+			column:  "stage_repo_id",
+			query:   checkStageRepoQuery,
+			message: "stage repository does not match the build repository",
+			fix:     "set the stage repository to the build repository",
+		},
+		repair: repairStageRepoStmt,
+	},
+	{
+		preflightCheck: preflightCheck{
+			name:    "orphaned-step",
+			table:   "steps",
+			column:  "step_stage_id",
+			query:   checkStepStageQuery,
+			message: "stage does not exist",
+			fix:     "delete the step",
+		},
+		repair: repairStepStageStmt,
+	},
+	{
+		preflightCheck: preflightCheck{
+			name:    "orphaned-log",
+			table:   "logs",
+			column:  "log_id",
+			query:   checkLogStepQuery,
+			message: "step does not exist",
+			fix:     "delete the logs",
+		},
+		repair: repairLogStepStmt,
+	},
+	{
+		preflightCheck: preflightCheck{
+			name:    "orphaned-perm-user",
+			table:   "perms",
+			column:  "perm_user_id",
+			query:   checkPermUserQuery,
+			message: "user does not exist",
+			fix:     "delete the permission",
+		},
+		repair: repairPermUserStmt,
+	},
+	{
+		preflightCheck: preflightCheck{
+			name:    "orphaned-perm-repo",
+			table:   "perms",
+			column:  "perm_repo_uid",
+			query:   checkPermRepoQuery,
+			message: "repository does not exist",
+			fix:     "delete the permission",
+		},
+		repair: repairPermRepoStmt,
+	},
+	{
+		preflightCheck: preflightCheck{
+			name:    "orphaned-secret",
+			table:   "secrets",
+			column:  "secret_repo_id",
+			query:   checkSecretRepoQuery,
+			message: "repository does not exist",
+			fix:     "delete the secret",
+		},
+		repair: repairSecretRepoStmt,
+	},
+	{
+		preflightCheck: preflightCheck{
+			name:    "repo-counter",
+			table:   "repos",
+			column:  "repo_counter",
+			query:   checkRepoCounterQuery,
+			message: "repository counter is less than the highest build number, new builds will violate the unique build number constraint",
+			fix:     "set the repository counter to the highest build number",
+		},
+		repair: repairRepoCounterStmt,
+	},
+	{
+		preflightCheck: preflightCheck{
+			name:    "build-timestamps",
+			table:   "builds",
+			column:  "build_finished",
+			query:   checkBuildTimestampQuery,
+			message: "build finished before it started, or finished without starting",
+			fix:     "correct the build started and finished timestamps",
+		},
+	},
+	{
+		preflightCheck: preflightCheck{
+			name:    "stage-timestamps",
+			table:   "stages",
+			column:  "stage_stopped",
+			query:   checkStageTimestampQuery,
+			message: "stage stopped before it started, or stopped without starting",
+			fix:     "correct the stage started and stopped timestamps",
+		},
+	},
+	{
+		preflightCheck: preflightCheck{
+			name:    "step-timestamps",
+			table:   "steps",
+			column:  "step_stopped",
+			query:   checkStepTimestampQuery,
+			message: "step stopped before it started, or stopped without starting",
+			fix:     "correct the step started and stopped timestamps",
+		},
+	},
+}
+
+// CheckTarget scans the V1 database for rows that violate
+// referential integrity, such as steps without a stage, or
+// that will otherwise fail at runtime, such as a repository
+// counter that is less than the highest build number. If
+// repair is true, the mechanically fixable rows are repaired
+// and the issues are marked as repaired.
+func CheckTarget(target *sql.DB, repair bool) ([]*Issue, error) {
+	tx, err := target.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	issues := []*Issue{}
+	for _, check := range targetChecks {
+		log := logrus.
+			WithField("check", check.name).
+			WithField("table", check.table).
+			WithField("column", check.column)
+		log.Debugln("run target check")
+
+		found, err := runPreflightCheck(tx, check.preflightCheck)
+		if err != nil {
+			log.WithError(err).Errorln("target check failed")
+			return nil, err
+		}
+		issues = append(issues, found...)
+		if len(found) == 0 {
+			continue
+		}
+
+		if !repair || check.repair == "" {
+			log.Warnf("target check found %d issues", len(found))
+			continue
+		}
+		if _, err := tx.Exec(check.repair); err != nil {
+			log.WithError(err).Errorln("target repair failed")
+			return nil, err
+		}
+		for _, issue := range found {
+			issue.Repaired = true
+		}
+		log.Infof("target check repaired %d issues", len(found))
+	}
+
+	if repair {
+		return issues, tx.Commit()
+	}
+	return issues, nil
+}
+
+const checkBuildRepoQuery = `
+SELECT build_id, build_repo_id
+FROM builds
+WHERE NOT EXISTS (
+    SELECT 1
+    FROM repos
+    WHERE repo_id = build_repo_id
+  )
+ORDER BY build_id
+`
+
+const repairBuildRepoStmt = `
+DELETE FROM builds
+WHERE NOT EXISTS (
+    SELECT 1
+    FROM repos
+    WHERE repo_id = build_repo_id
+  )
+`
+
+const checkStageBuildQuery = `
+SELECT stage_id, stage_build_id
+FROM stages
+WHERE NOT EXISTS (
+    SELECT 1
+    FROM builds
+    WHERE build_id = stage_build_id
+  )
+ORDER BY stage_id
+`
+
+const repairStageBuildStmt = `
+DELETE FROM stages
+WHERE NOT EXISTS (
+    SELECT 1
+    FROM builds
+    WHERE build_id = stage_build_id
+  )
+`
+
+const checkStageRepoQuery = `
+SELECT stage_id, stage_repo_id
+FROM stages
+INNER JOIN builds ON builds.build_id = stages.stage_build_id
+WHERE stage_repo_id != build_repo_id
+ORDER BY stage_id
+`
+
+const repairStageRepoStmt = `
+UPDATE stages
+SET stage_repo_id = (
+    SELECT build_repo_id
+    FROM builds
+    WHERE build_id = stage_build_id
+  )
+WHERE EXISTS (
+    SELECT 1
+    FROM builds
+    WHERE build_id = stage_build_id
+      AND build_repo_id != stage_repo_id
+  )
+`
+
+const checkStepStageQuery = `
+SELECT step_id, step_stage_id
+FROM steps
+WHERE NOT EXISTS (
+    SELECT 1
+    FROM stages
+    WHERE stage_id = step_stage_id
+  )
+ORDER BY step_id
+`
+
+const repairStepStageStmt = `
+DELETE FROM steps
+WHERE NOT EXISTS (
+    SELECT 1
+    FROM stages
+    WHERE stage_id = step_stage_id
+  )
+`
+
+const checkLogStepQuery = `
+SELECT log_id, NULL
+FROM logs
+WHERE NOT EXISTS (
+    SELECT 1
+    FROM steps
+    WHERE step_id = log_id
+  )
+ORDER BY log_id
+`
+
+const repairLogStepStmt = `
+DELETE FROM logs
+WHERE NOT EXISTS (
+    SELECT 1
+    FROM steps
+    WHERE step_id = log_id
+  )
+`
+
+const checkPermUserQuery = `
+SELECT perm_user_id, perm_repo_uid
+FROM perms
+WHERE NOT EXISTS (
+    SELECT 1
+    FROM users
+    WHERE user_id = perm_user_id
+  )
+ORDER BY perm_user_id, perm_repo_uid
+`
+
+const repairPermUserStmt = `
+DELETE FROM perms
+WHERE NOT EXISTS (
+    SELECT 1
+    FROM users
+    WHERE user_id = perm_user_id
+  )
+`
+
+const checkPermRepoQuery = `
+SELECT perm_user_id, perm_repo_uid
+FROM perms
+WHERE NOT EXISTS (
+    SELECT 1
+    FROM repos
+    WHERE repo_uid = perm_repo_uid
+  )
+ORDER BY perm_user_id, perm_repo_uid
+`
+
+const repairPermRepoStmt = `
+DELETE FROM perms
+WHERE NOT EXISTS (
+    SELECT 1
+    FROM repos
+    WHERE repo_uid = perm_repo_uid
+  )
+`
+
+const checkSecretRepoQuery = `
+SELECT secret_id, secret_repo_id
+FROM secrets
+WHERE NOT EXISTS (
+    SELECT 1
+    FROM repos
+    WHERE repo_id = secret_repo_id
+  )
+ORDER BY secret_id
+`
+
+const repairSecretRepoStmt = `
+DELETE FROM secrets
+WHERE NOT EXISTS (
+    SELECT 1
+    FROM repos
+    WHERE repo_id = secret_repo_id
+  )
+`
+
+const checkRepoCounterQuery = `
+SELECT repo_id, repo_counter
+FROM repos
+WHERE repo_counter < (
+    SELECT MAX(build_number)
+    FROM builds
+    WHERE build_repo_id = repo_id
+  )
+ORDER BY repo_id
+`
+
+const repairRepoCounterStmt = `
+UPDATE repos
+SET repo_counter = (
+    SELECT MAX(build_number)
+    FROM builds
+    WHERE build_repo_id = repo_id
+  )
+WHERE repo_counter < (
+    SELECT MAX(build_number)
+    FROM builds
+    WHERE build_repo_id = repo_id
+  )
+`
+
+const checkBuildTimestampQuery = `
+SELECT build_id, build_finished
+FROM builds
+WHERE build_finished > 0
+  AND (build_finished < build_started OR build_started = 0)
+ORDER BY build_id
+`
+
+const checkStageTimestampQuery = `
+SELECT stage_id, stage_stopped
+FROM stages
+WHERE stage_stopped > 0
+  AND (stage_stopped < stage_started OR stage_started = 0)
+ORDER BY stage_id
+`
+
+const checkStepTimestampQuery = `
+SELECT step_id, step_stopped
+FROM steps
+WHERE step_stopped > 0
+  AND (step_stopped < step_started OR step_started = 0)
+ORDER BY step_id
+`
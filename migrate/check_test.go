@@ -0,0 +1,151 @@
+package migrate
+
+import (
+	"database/sql"
+	"reflect"
+	"testing"
+
+	"github.com/russross/meddler"
+)
+
+func TestCheckTarget(t *testing.T) {
+	target := openTarget(t)
+
+	rows := []struct {
+		table string
+		row   interface{}
+	}{
+		{"users", &UserV1{ID: 1, Login: "octocat", Hash: "1"}},
+		{"repos", &RepoV1{ID: 1, UID: "1", UserID: 1, Slug: "octocat/hello-world", Counter: 1}},
+		// the repository counter is less than the build
+		// number, and the build finished before it started.
+		{"builds", &BuildV1{ID: 1, RepoID: 1, Number: 5, Started: 10, Finished: 5}},
+		{"builds", &BuildV1{ID: 2, RepoID: 9, Number: 1}},
+		{"stages", &StageV1{ID: 1, RepoID: 2, BuildID: 1, Number: 1}},
+		{"stages", &StageV1{ID: 2, RepoID: 9, BuildID: 2, Number: 1}},
+		{"stages", &StageV1{ID: 3, RepoID: 1, BuildID: 99, Number: 1}},
+		{"steps", &StepV1{ID: 1, StageID: 1, Number: 1}},
+		{"steps", &StepV1{ID: 2, StageID: 2, Number: 1}},
+		{"logs", &LogsV1{ID: 1, Data: []byte("[]")}},
+		{"logs", &LogsV1{ID: 2, Data: []byte("[]")}},
+		{"logs", &LogsV1{ID: 3, Data: []byte("[]")}},
+		{"perms", &PermV1{UserID: 1, RepoUID: "1"}},
+		{"perms", &PermV1{UserID: 2, RepoUID: "1"}},
+		{"perms", &PermV1{UserID: 1, RepoUID: "9"}},
+		{"secrets", &SecretV1{ID: 1, RepoID: 1, Name: "password"}},
+		{"secrets", &SecretV1{ID: 2, RepoID: 9, Name: "password"}},
+	}
+	for _, row := range rows {
+		if err := meddler.Insert(target, row.table, row.row); err != nil {
+			t.Fatalf("insert %s: %s", row.table, err)
+		}
+	}
+
+	// the stage, step and logs of the orphaned build are only
+	// orphaned once the build is deleted.
+	issues, err := CheckTarget(target, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []checkResult{
+		{"orphaned-build", 2, false},
+		{"orphaned-stage", 3, false},
+		{"stage-repo", 1, false},
+		{"orphaned-log", 3, false},
+		{"orphaned-perm-user", 2, false},
+		{"orphaned-perm-repo", 1, false},
+		{"orphaned-secret", 2, false},
+		{"repo-counter", 1, false},
+		{"build-timestamps", 1, false},
+	}
+	if got := checkResults(issues); !reflect.DeepEqual(got, want) {
+		t.Errorf("check: want issues\n%v\ngot\n%v", want, got)
+	}
+
+	issues, err = CheckTarget(target, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []checkResult{
+		{"orphaned-build", 2, true},
+		{"orphaned-stage", 2, true},
+		{"orphaned-stage", 3, true},
+		{"stage-repo", 1, true},
+		{"orphaned-step", 2, true},
+		{"orphaned-log", 2, true},
+		{"orphaned-log", 3, true},
+		{"orphaned-perm-user", 2, true},
+		{"orphaned-perm-repo", 1, true},
+		{"orphaned-secret", 2, true},
+		{"repo-counter", 1, true},
+		{"build-timestamps", 1, false},
+	}
+	if got := checkResults(issues); !reflect.DeepEqual(got, want) {
+		t.Errorf("repair: want issues\n%v\ngot\n%v", want, got)
+	}
+
+	counts := map[string]int{
+		"builds":  1,
+		"stages":  1,
+		"steps":   1,
+		"logs":    1,
+		"perms":   1,
+		"secrets": 1,
+	}
+	for table, want := range counts {
+		if got := tableRows(t, target, table); got != want {
+			t.Errorf("want %d %s after repair, got %d", want, table, got)
+		}
+	}
+
+	var stageRepo, counter int64
+	if err := target.QueryRow("SELECT stage_repo_id FROM stages WHERE stage_id = 1").Scan(&stageRepo); err != nil {
+		t.Fatal(err)
+	}
+	if stageRepo != 1 {
+		t.Errorf("want stage repository 1, got %d", stageRepo)
+	}
+	if err := target.QueryRow("SELECT repo_counter FROM repos WHERE repo_id = 1").Scan(&counter); err != nil {
+		t.Fatal(err)
+	}
+	if counter != 5 {
+		t.Errorf("want repository counter 5, got %d", counter)
+	}
+
+	// the timestamps cannot be repaired.
+	issues, err = CheckTarget(target, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []checkResult{{"build-timestamps", 1, false}}
+	if got := checkResults(issues); !reflect.DeepEqual(got, want) {
+		t.Errorf("after repair: want issues\n%v\ngot\n%v", want, got)
+	}
+}
+
+// checkResult is the check, identifier and repair status of
+// an issue.
+type checkResult struct {
+	check    string
+	id       int64
+	repaired bool
+}
+
+// helper function returns the results of the issues.
+func checkResults(issues []*Issue) []checkResult {
+	results := []checkResult{}
+	for _, issue := range issues {
+		results = append(results, checkResult{issue.Check, issue.ID, issue.Repaired})
+	}
+	return results
+}
+
+// helper function returns the number of rows in the table.
+func tableRows(t *testing.T, target *sql.DB, table string) int {
+	t.Helper()
+	var count int
+	if err := target.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
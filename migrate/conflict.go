@@ -0,0 +1,247 @@
+package migrate
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/russross/meddler"
+)
+
+// ConflictPolicy defines how a row that conflicts with an
+// existing row in the V1 database is inserted.
+type ConflictPolicy string
+
+// Conflict policy values.
+const (
+	// ConflictFail fails the insert, and therefore the
+	// migration step.
+	ConflictFail ConflictPolicy = "fail"
+
+	// ConflictSkip keeps the existing row.
+	ConflictSkip ConflictPolicy = "skip"
+
+	// ConflictUpdate updates the existing row. The primary
+	// and unique key columns of the existing row are kept.
+	ConflictUpdate ConflictPolicy = "update"
+)
+
+// ParseConflictPolicy parses the conflict policy. An empty
+// string is parsed as ConflictFail.
+func ParseConflictPolicy(s string) (ConflictPolicy, error) {
+	switch p := ConflictPolicy(s); p {
+	case "":
+		return ConflictFail, nil
+	case ConflictFail, ConflictSkip, ConflictUpdate:
+		return p, nil
+	default:
+		return "", fmt.Errorf("invalid conflict policy: %s", s)
+	}
+}
+
+// conflictKeys defines the unique keys of each table that are
+// used to detect a conflict with an existing row, in order of
+// preference. The first key whose columns are all inserted is
+// used. Rows are migrated with their V0 identifier, so the key
+// is the primary key, except for registries which are migrated
+// to secrets without an identifier. A row that conflicts on
+// one key is only updated if the other keys match.
+var conflictKeys = map[string][]string{
+	"users":   {"user_id"},
+	"repos":   {"repo_id"},
+	"builds":  {"build_id"},
+	"stages":  {"stage_id"},
+	"steps":   {"step_id"},
+	"logs":    {"log_id"},
+	"secrets": {"secret_id", "secret_repo_id, secret_name"},
+}
+
+// uniqueKeys defines the primary and unique key columns of
+// each table, which are not updated when a row conflicts with
+// an existing row. Mysql updates the row that conflicts on any
+// unique key, so updating these columns could rewrite the
+// identifier of a row that conflicts on a secondary key.
+var uniqueKeys = map[string][]string{
+	"users":   {"user_id", "user_login", "user_hash"},
+	"repos":   {"repo_id", "repo_slug", "repo_uid"},
+	"builds":  {"build_id", "build_repo_id", "build_number"},
+	"stages":  {"stage_id", "stage_build_id", "stage_number"},
+	"steps":   {"step_id", "step_stage_id", "step_number"},
+	"logs":    {"log_id"},
+	"secrets": {"secret_id", "secret_repo_id", "secret_name"},
+}
+
+// helper function inserts the row into the table, resolving
+// conflicts with an existing row using the policy. It returns
+// false if the row was not inserted because it conflicts with
+// an existing row. Unlike meddler.Insert, the primary key of
+// the row is not updated after the insert.
+func insertRow(db meddler.DB, table string, src interface{}, policy ConflictPolicy) (bool, error) {
+	if policy == "" || policy == ConflictFail {
+		return true, meddler.Insert(db, table, src)
+	}
+
+	columns, err := meddler.Columns(src, false)
+	if err != nil {
+		return false, err
+	}
+	placeholders, err := meddler.PlaceholdersString(src, false)
+	if err != nil {
+		return false, err
+	}
+	values, err := meddler.Values(src, false)
+	if err != nil {
+		return false, err
+	}
+
+	stmt, err := insertStmt(table, columns, placeholders, policy)
+	if err != nil {
+		return false, err
+	}
+	res, err := db.Exec(stmt, values...)
+	if err != nil {
+		return false, err
+	}
+	if policy == ConflictUpdate && meddler.Default == meddler.MySQL {
+		// the number of affected rows of a mysql update is
+		// not reliable, since mysql reports zero rows if the
+		// existing row already has the same values.
+		return true, nil
+	}
+	// the number of affected rows is zero if the insert is
+	// skipped, or the existing row is not updated.
+	n, err := res.RowsAffected()
+	return n != 0, err
+}
+
+// helper function returns the insert statement for the
+// target database dialect and conflict policy. The existing
+// row is only updated if its conflict keys match the inserted
+// row, so that a row that conflicts with a different row, for
+// example a secret whose identifier is used by a registry,
+// does not replace the values of that row.
+func insertStmt(table string, columns []string, placeholders string, policy ConflictPolicy) (string, error) {
+	insert := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", table, strings.Join(columns, ", "), placeholders)
+
+	switch meddler.Default {
+	case meddler.MySQL:
+		if policy == ConflictSkip {
+			// a no-op update does not affect the row, unlike
+			// INSERT IGNORE which also ignores invalid values.
+			return fmt.Sprintf("%s ON DUPLICATE KEY UPDATE %s = %s", insert, columns[0], columns[0]), nil
+		}
+		// mysql updates the row that conflicts on any unique
+		// key, so all conflict keys are compared.
+		updated, err := updateColumns(table, columns)
+		if err != nil {
+			return "", err
+		}
+		keys := matchColumns(table, columns, "")
+		match := make([]string, len(keys))
+		for i, column := range keys {
+			match[i] = fmt.Sprintf("%s <=> VALUES(%s)", column, column)
+		}
+		set := make([]string, len(updated))
+		for i, column := range updated {
+			if len(match) == 0 {
+				set[i] = fmt.Sprintf("%s = VALUES(%s)", column, column)
+			} else {
+				set[i] = fmt.Sprintf("%s = IF(%s, VALUES(%s), %s)", column, strings.Join(match, " AND "), column, column)
+			}
+		}
+		return fmt.Sprintf("%s ON DUPLICATE KEY UPDATE %s", insert, strings.Join(set, ", ")), nil
+	default:
+		// postgres and sqlite only update the row that
+		// conflicts on the key, and fail if the row conflicts
+		// on another unique key.
+		if policy == ConflictSkip {
+			return insert + " ON CONFLICT DO NOTHING", nil
+		}
+		key, ok := conflictKey(table, columns)
+		if !ok {
+			return "", fmt.Errorf("cannot update table %s on conflict", table)
+		}
+		updated, err := updateColumns(table, columns)
+		if err != nil {
+			return "", err
+		}
+		keys := matchColumns(table, columns, key)
+		set := make([]string, len(updated))
+		for i, column := range updated {
+			set[i] = fmt.Sprintf("%s = EXCLUDED.%s", column, column)
+		}
+		stmt := fmt.Sprintf("%s ON CONFLICT (%s) DO UPDATE SET %s", insert, key, strings.Join(set, ", "))
+		if len(keys) == 0 {
+			return stmt, nil
+		}
+		match := make([]string, len(keys))
+		for i, column := range keys {
+			match[i] = fmt.Sprintf("%s.%s = EXCLUDED.%s", table, column, column)
+		}
+		return stmt + " WHERE " + strings.Join(match, " AND "), nil
+	}
+}
+
+// helper function returns the first conflict key of the table
+// whose columns are all inserted.
+func conflictKey(table string, columns []string) (string, bool) {
+	inserted := map[string]bool{}
+	for _, column := range columns {
+		inserted[column] = true
+	}
+	for _, key := range conflictKeys[table] {
+		ok := true
+		for _, column := range strings.Split(key, ", ") {
+			ok = ok && inserted[column]
+		}
+		if ok {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// helper function returns the inserted columns that update
+// an existing row, excluding the primary and unique key
+// columns.
+func updateColumns(table string, columns []string) ([]string, error) {
+	keys, ok := uniqueKeys[table]
+	if !ok {
+		return nil, fmt.Errorf("cannot update table %s on conflict", table)
+	}
+	excluded := map[string]bool{}
+	for _, key := range keys {
+		excluded[key] = true
+	}
+	var updated []string
+	for _, column := range columns {
+		if !excluded[column] {
+			updated = append(updated, column)
+		}
+	}
+	if len(updated) == 0 {
+		return nil, fmt.Errorf("cannot update table %s on conflict", table)
+	}
+	return updated, nil
+}
+
+// helper function returns the inserted columns of the conflict
+// keys of the table, excluding the columns of the given key,
+// which must match the existing row for the row to be updated.
+func matchColumns(table string, columns []string, key string) []string {
+	inserted := map[string]bool{}
+	for _, column := range columns {
+		inserted[column] = true
+	}
+	for _, column := range strings.Split(key, ", ") {
+		inserted[column] = false
+	}
+	var match []string
+	for _, key := range conflictKeys[table] {
+		for _, column := range strings.Split(key, ", ") {
+			if inserted[column] {
+				match = append(match, column)
+			}
+		}
+	}
+	return match
+}
@@ -0,0 +1,148 @@
+package migrate
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/russross/meddler"
+)
+
+func TestInsertStmt(t *testing.T) {
+	logs := []string{"log_id", "log_data"}
+	secrets := []string{"secret_id", "secret_repo_id", "secret_name", "secret_data"}
+	registries := []string{"secret_repo_id", "secret_name", "secret_data"}
+
+	tests := []struct {
+		dialect      *meddler.Database
+		table        string
+		columns      []string
+		placeholders string
+		policy       ConflictPolicy
+		want         string
+	}{
+		// postgres
+		{
+			meddler.PostgreSQL, "logs", logs, "$1, $2", ConflictSkip,
+			"INSERT INTO logs (log_id, log_data) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+		},
+		{
+			meddler.PostgreSQL, "logs", logs, "$1, $2", ConflictUpdate,
+			"INSERT INTO logs (log_id, log_data) VALUES ($1, $2) ON CONFLICT (log_id) DO UPDATE SET log_data = EXCLUDED.log_data",
+		},
+		{
+			meddler.PostgreSQL, "secrets", secrets, "$1, $2, $3, $4", ConflictUpdate,
+			"INSERT INTO secrets (secret_id, secret_repo_id, secret_name, secret_data) VALUES ($1, $2, $3, $4)" +
+				" ON CONFLICT (secret_id) DO UPDATE SET secret_data = EXCLUDED.secret_data" +
+				" WHERE secrets.secret_repo_id = EXCLUDED.secret_repo_id AND secrets.secret_name = EXCLUDED.secret_name",
+		},
+		{
+			meddler.PostgreSQL, "secrets", registries, "$1, $2, $3", ConflictUpdate,
+			"INSERT INTO secrets (secret_repo_id, secret_name, secret_data) VALUES ($1, $2, $3)" +
+				" ON CONFLICT (secret_repo_id, secret_name) DO UPDATE SET secret_data = EXCLUDED.secret_data",
+		},
+		// sqlite
+		{
+			meddler.SQLite, "logs", logs, "?, ?", ConflictSkip,
+			"INSERT INTO logs (log_id, log_data) VALUES (?, ?) ON CONFLICT DO NOTHING",
+		},
+		{
+			meddler.SQLite, "logs", logs, "?, ?", ConflictUpdate,
+			"INSERT INTO logs (log_id, log_data) VALUES (?, ?) ON CONFLICT (log_id) DO UPDATE SET log_data = EXCLUDED.log_data",
+		},
+		// mysql
+		{
+			meddler.MySQL, "logs", logs, "?, ?", ConflictSkip,
+			"INSERT INTO logs (log_id, log_data) VALUES (?, ?) ON DUPLICATE KEY UPDATE log_id = log_id",
+		},
+		{
+			meddler.MySQL, "logs", logs, "?, ?", ConflictUpdate,
+			"INSERT INTO logs (log_id, log_data) VALUES (?, ?)" +
+				" ON DUPLICATE KEY UPDATE log_data = IF(log_id <=> VALUES(log_id), VALUES(log_data), log_data)",
+		},
+		{
+			meddler.MySQL, "secrets", registries, "?, ?, ?", ConflictUpdate,
+			"INSERT INTO secrets (secret_repo_id, secret_name, secret_data) VALUES (?, ?, ?)" +
+				" ON DUPLICATE KEY UPDATE secret_data = IF(secret_repo_id <=> VALUES(secret_repo_id) AND secret_name <=> VALUES(secret_name), VALUES(secret_data), secret_data)",
+		},
+	}
+
+	dialect := meddler.Default
+	defer func() { meddler.Default = dialect }()
+	for _, test := range tests {
+		meddler.Default = test.dialect
+		got, err := insertStmt(test.table, test.columns, test.placeholders, test.policy)
+		if err != nil {
+			t.Errorf("%s %s: %s", test.table, test.policy, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s %s: want\n%s\ngot\n%s", test.table, test.policy, test.want, got)
+		}
+	}
+
+	for _, dialect := range []*meddler.Database{meddler.PostgreSQL, meddler.MySQL, meddler.SQLite} {
+		meddler.Default = dialect
+		if _, err := insertStmt("cron", []string{"cron_id", "cron_name"}, "?, ?", ConflictUpdate); err == nil {
+			t.Errorf("want error updating a table without conflict keys")
+		}
+	}
+}
+
+func TestInsertRow(t *testing.T) {
+	target := openTarget(t)
+
+	secret := &SecretV1{ID: 1, RepoID: 1, Name: "password", Data: "old"}
+	if inserted, err := insertRow(target, "secrets", secret, ConflictSkip); err != nil || !inserted {
+		t.Fatalf("want secret inserted, got %v, %v", inserted, err)
+	}
+
+	secret.Data = "new"
+	if inserted, err := insertRow(target, "secrets", secret, ConflictSkip); err != nil || inserted {
+		t.Errorf("want conflicting secret skipped, got %v, %v", inserted, err)
+	}
+	if got := secretData(t, target, 1); got != "old" {
+		t.Errorf("want skipped secret to keep %q, got %q", "old", got)
+	}
+
+	if inserted, err := insertRow(target, "secrets", secret, ConflictUpdate); err != nil || !inserted {
+		t.Errorf("want conflicting secret updated, got %v, %v", inserted, err)
+	}
+	if got := secretData(t, target, 1); got != "new" {
+		t.Errorf("want updated secret %q, got %q", "new", got)
+	}
+
+	// registries are inserted without an identifier, and
+	// conflict on the repository and name.
+	registry := &RegistryV1{RepoID: 1, Name: ".dockerconfigjson", Data: "{}"}
+	if _, err := insertRow(target, "secrets", registry, ConflictUpdate); err != nil {
+		t.Fatal(err)
+	}
+	registry.Data = `{"auths":{}}`
+	if inserted, err := insertRow(target, "secrets", registry, ConflictUpdate); err != nil || !inserted {
+		t.Errorf("want conflicting registry updated, got %v, %v", inserted, err)
+	}
+	if got := secretData(t, target, 2); got != registry.Data {
+		t.Errorf("want updated registry %q, got %q", registry.Data, got)
+	}
+
+	// a secret whose identifier is used by the registry does
+	// not replace the registry.
+	other := &SecretV1{ID: 2, RepoID: 2, Name: "token", Data: "token"}
+	if inserted, err := insertRow(target, "secrets", other, ConflictUpdate); err != nil || inserted {
+		t.Errorf("want secret conflicting with a different row skipped, got %v, %v", inserted, err)
+	}
+	if got := secretData(t, target, 2); got != registry.Data {
+		t.Errorf("want registry %q kept, got %q", registry.Data, got)
+	}
+}
+
+// helper function returns the data of the secret.
+func secretData(t *testing.T, target *sql.DB, id int64) string {
+	t.Helper()
+	var data string
+	err := target.QueryRow("SELECT secret_data FROM secrets WHERE secret_id = ?", id).Scan(&data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
@@ -10,12 +10,17 @@ import (
 
 // Create creates the 1.0 database.
 func Create(db *sql.DB, driver string) error {
+	var err error
 	switch driver {
 	case "mysql":
-		return mysql.Migrate(db)
+		err = mysql.Migrate(db)
 	case "postgres":
-		return postgres.Migrate(db)
+		err = postgres.Migrate(db)
 	default:
-		return sqlite.Migrate(db)
+		err = sqlite.Migrate(db)
 	}
+	if err != nil {
+		return err
+	}
+	return createLedger(db)
 }
@@ -0,0 +1,54 @@
+package db
+
+import "database/sql"
+
+// createLedger creates the tables used to record the progress,
+// the sync watermarks and the failed records of each migration
+// step. The ddl is compatible with all of the supported
+// database drivers.
+func createLedger(db *sql.DB) error {
+	for _, stmt := range []string{
+		ledgerTableCreate,
+		watermarkTableCreate,
+		failureTableCreate,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var ledgerTableCreate = `
+CREATE TABLE IF NOT EXISTS migrate_ledger (
+ ledger_step     VARCHAR(250) PRIMARY KEY
+,ledger_status   VARCHAR(50)
+,ledger_rows     BIGINT
+,ledger_last_id  BIGINT
+,ledger_error    TEXT
+,ledger_started  BIGINT
+,ledger_finished BIGINT
+);
+`
+
+var watermarkTableCreate = `
+CREATE TABLE IF NOT EXISTS migrate_watermarks (
+ watermark_step    VARCHAR(250) PRIMARY KEY
+,watermark_value   BIGINT
+,watermark_updated BIGINT
+);
+`
+
+var failureTableCreate = `
+CREATE TABLE IF NOT EXISTS migrate_failures (
+ failure_step     VARCHAR(250)
+,failure_entity   VARCHAR(50)
+,failure_id       BIGINT
+,failure_status   VARCHAR(50)
+,failure_error    TEXT
+,failure_attempts BIGINT
+,failure_created  BIGINT
+,failure_updated  BIGINT
+,PRIMARY KEY (failure_step, failure_id)
+);
+`
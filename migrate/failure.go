@@ -0,0 +1,303 @@
+package migrate
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/russross/meddler"
+	"github.com/sirupsen/logrus"
+)
+
+// ErrorPolicy defines how a record that fails to migrate is
+// handled.
+type ErrorPolicy string
+
+// Error policy values.
+const (
+	// ErrorAbort records the failed record and aborts the
+	// migration step.
+	ErrorAbort ErrorPolicy = "abort"
+
+	// ErrorSkip records the failed record and continues with
+	// the next record. The record is reported as failed, and
+	// the command fails once all steps are complete.
+	ErrorSkip ErrorPolicy = "skip"
+
+	// ErrorQuarantine records the failed record and continues
+	// with the next record. The record is reported as skipped,
+	// and is only retried on request.
+	ErrorQuarantine ErrorPolicy = "quarantine"
+)
+
+// ParseErrorPolicy parses the error policy. An empty string
+// is parsed as an empty policy, which selects the default
+// policy of each migration step.
+func ParseErrorPolicy(s string) (ErrorPolicy, error) {
+	switch p := ErrorPolicy(s); p {
+	case "", ErrorAbort, ErrorSkip, ErrorQuarantine:
+		return p, nil
+	default:
+		return "", fmt.Errorf("invalid error policy: %s", s)
+	}
+}
+
+// Failure status values.
+const (
+	FailureFailed      = "failed"
+	FailureQuarantined = "quarantined"
+)
+
+// Failure records a record that failed to migrate in the
+// target database, so that it can be retried without
+// re-running the migration step.
+type Failure struct {
+	Step     string `meddler:"failure_step"`
+	Entity   string `meddler:"failure_entity"`
+	ID       int64  `meddler:"failure_id"`
+	Status   string `meddler:"failure_status"`
+	Error    string `meddler:"failure_error"`
+	Attempts int64  `meddler:"failure_attempts"`
+	Created  int64  `meddler:"failure_created"`
+	Updated  int64  `meddler:"failure_updated"`
+}
+
+// ListFailures returns the failed records of all migration
+// steps, ordered by step and identifier.
+func ListFailures(target *sql.DB) ([]*Failure, error) {
+	failures := []*Failure{}
+	err := meddler.QueryAll(target, &failures, failureListQuery)
+	return failures, err
+}
+
+// failureEntities defines the kind of record identified by
+// the failure identifier of each migration step.
+var failureEntities = map[string]string{
+	"migrate-users":      "user",
+	"migrate-repos":      "repo",
+	"migrate-secrets":    "secret",
+	"migrate-registries": "repo",
+	"migrate-builds":     "build",
+	"migrate-stages":     "stage",
+	"migrate-steps":      "step",
+	"migrate-logs":       "step",
+	"update-repos":       "repo",
+	"merge-renamed":      "repo",
+	"remove-renamed":     "repo",
+	"remove-not-found":   "repo",
+	"activate-repos":     "repo",
+}
+
+// helper function returns the kind of record identified by
+// the failure identifier of the migration step. The log
+// migration step is named after the log sink.
+func failureEntity(step string) string {
+	if strings.HasPrefix(step, "migrate-logs") {
+		return failureEntities["migrate-logs"]
+	}
+	return failureEntities[step]
+}
+
+// failureLog tracks the failed records of a migration step.
+// Failures and resolved records are buffered, and written to
+// the target database when flushed, so that they are written
+// in the same transaction as the migrated rows.
+type failureLog struct {
+	step   string
+	entity string
+	policy ErrorPolicy
+	dryRun bool
+	report *StepReport
+
+	// retry is the set of record identifiers being retried,
+	// or nil if the step is not being retried.
+	retry map[int64]bool
+
+	pending  []*Failure
+	resolved []int64
+
+	// aborted is true if a failed record aborted the step.
+	aborted bool
+}
+
+// helper function returns the failure log of the migration
+// step. The fallback policy is used if the error policy is
+// not configured.
+func newFailureLog(step string, opts Options, report *StepReport, fallback ErrorPolicy) *failureLog {
+	l := &failureLog{
+		step:   step,
+		entity: failureEntity(step),
+		policy: opts.OnError,
+		dryRun: opts.DryRun,
+		report: report,
+	}
+	if l.policy == "" {
+		l.policy = fallback
+	}
+	if opts.Retry != nil {
+		l.retry = map[int64]bool{}
+		for _, id := range opts.Retry {
+			l.retry[id] = true
+		}
+	}
+	return l
+}
+
+// helper function returns true if the step is being retried.
+func (l *failureLog) retrying() bool {
+	return l.retry != nil
+}
+
+// helper function returns true if the record should be
+// processed. When the step is being retried, only the
+// records being retried are processed.
+func (l *failureLog) selected(id int64) bool {
+	return l.retry == nil || l.retry[id]
+}
+
+// helper function returns the number of rows the step is
+// expected to process. When the step is retried, only the
+// records being retried are processed.
+func (l *failureLog) expected(rows int64) int64 {
+	if l.retry != nil {
+		return int64(len(l.retry))
+	}
+	return rows
+}
+
+// helper function returns the identifier after which the
+// retried records are read from the source database.
+func (l *failureLog) after() int64 {
+	var min int64
+	for id := range l.retry {
+		if min == 0 || id < min {
+			min = id
+		}
+	}
+	if min == 0 {
+		return 0
+	}
+	return min - 1
+}
+
+// helper function records the failed record, and returns the
+// error if the migration step must be aborted.
+func (l *failureLog) fail(id int64, reason string, err error, log *logrus.Entry) error {
+	status := FailureFailed
+	if l.policy == ErrorQuarantine {
+		status = FailureQuarantined
+		l.report.Skipped++
+		l.report.Warnings["quarantined: "+reason]++
+		log.WithError(err).Warnf("%s, record quarantined", reason)
+	} else {
+		l.report.fail(reason)
+		log.WithError(err).Errorln(reason)
+	}
+
+	l.pending = append(l.pending, &Failure{
+		Step:   l.step,
+		Entity: l.entity,
+		ID:     id,
+		Status: status,
+		Error:  err.Error(),
+	})
+
+	if l.policy == ErrorAbort {
+		l.aborted = true
+		return err
+	}
+	return nil
+}
+
+// helper function records a record that was migrated, removing
+// a previous failure of the record from the failure ledger.
+func (l *failureLog) resolve(id int64) {
+	l.resolved = append(l.resolved, id)
+}
+
+// helper function discards the buffered failures, for example
+// when the transaction in which they would be written is
+// rolled back.
+func (l *failureLog) discard() {
+	l.pending = nil
+	l.resolved = nil
+}
+
+// helper function writes the buffered failures to the failure
+// ledger. The attempts of a record that failed before are
+// incremented. In dry run mode nothing is written.
+func (l *failureLog) flush(db meddler.DB) error {
+	if l.dryRun {
+		l.discard()
+		return nil
+	}
+	for _, id := range l.resolved {
+		if _, err := db.Exec(rebind(failureDeleteStmt), l.step, id); err != nil {
+			return err
+		}
+	}
+	for _, failure := range l.pending {
+		if err := saveFailure(db, failure); err != nil {
+			return err
+		}
+	}
+	l.discard()
+	return nil
+}
+
+// helper function inserts the failure, or updates the failure
+// if the record failed before.
+func saveFailure(db meddler.DB, failure *Failure) error {
+	now := time.Now().Unix()
+	existing := &Failure{}
+	err := meddler.QueryRow(db, existing, rebind(failureFindQuery), failure.Step, failure.ID)
+	if err == sql.ErrNoRows {
+		failure.Attempts = 1
+		failure.Created = now
+		failure.Updated = now
+		return meddler.Insert(db, "migrate_failures", failure)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(rebind(failureUpdateStmt),
+		failure.Status,
+		failure.Error,
+		existing.Attempts+1,
+		now,
+		failure.Step,
+		failure.ID,
+	)
+	return err
+}
+
+const failureListQuery = `
+SELECT *
+FROM migrate_failures
+ORDER BY failure_step, failure_id
+`
+
+const failureFindQuery = `
+SELECT *
+FROM migrate_failures
+WHERE failure_step = ?
+  AND failure_id = ?
+`
+
+const failureUpdateStmt = `
+UPDATE migrate_failures
+SET
+ failure_status = ?
+,failure_error = ?
+,failure_attempts = ?
+,failure_updated = ?
+WHERE failure_step = ?
+  AND failure_id = ?
+`
+
+const failureDeleteStmt = `
+DELETE FROM migrate_failures
+WHERE failure_step = ?
+  AND failure_id = ?
+`
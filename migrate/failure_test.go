@@ -0,0 +1,117 @@
+package migrate
+
+import (
+	"database/sql"
+	"reflect"
+	"testing"
+
+	"github.com/russross/meddler"
+)
+
+func TestFailureRetry(t *testing.T) {
+	source := openSource(t)
+	target := openTarget(t)
+
+	execAll(t, source,
+		`INSERT INTO users (user_id, user_login, user_hash) VALUES (1, 'octocat', '1')`,
+		`INSERT INTO users (user_id, user_login, user_hash) VALUES (2, 'hubot', '2')`,
+		`INSERT INTO users (user_id, user_login, user_hash) VALUES (3, 'spaceghost', '3')`,
+	)
+	// user 2 conflicts with the login of an existing user.
+	if err := meddler.Insert(target, "users", &UserV1{ID: 99, Login: "hubot", Hash: "99"}); err != nil {
+		t.Fatal(err)
+	}
+
+	report := new(Report)
+	if err := MigrateUsers(source, target, Options{OnError: ErrorQuarantine, Report: report}); err != nil {
+		t.Fatal(err)
+	}
+	if got := report.Steps[0]; got.Inserted != 2 || got.Skipped != 1 || got.Failed != 0 {
+		t.Errorf("want 2 users inserted and 1 quarantined, got %+v", got)
+	}
+	failures, err := ListFailures(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failures) != 1 {
+		t.Fatalf("want 1 failure recorded, got %d", len(failures))
+	}
+	got := failures[0]
+	if got.Step != "migrate-users" || got.Entity != "user" || got.ID != 2 || got.Status != FailureQuarantined || got.Attempts != 1 {
+		t.Errorf("want user 2 quarantined, got %+v", got)
+	}
+	assertLedger(t, target, "migrate-users", 3)
+
+	// the quarantined user is retried once the conflicting user
+	// is removed. The retry does not move the ledger.
+	if _, err := target.Exec("DELETE FROM users WHERE user_id = 99"); err != nil {
+		t.Fatal(err)
+	}
+	report = new(Report)
+	if err := MigrateUsers(source, target, Options{Retry: []int64{2}, Report: report}); err != nil {
+		t.Fatal(err)
+	}
+	if got := report.Steps[0]; got.Read != 1 || got.Inserted != 1 {
+		t.Errorf("want 1 user retried and inserted, got %+v", got)
+	}
+	if failures, err := ListFailures(target); err != nil || len(failures) != 0 {
+		t.Errorf("want failures cleared after retry, got %v, %v", failures, err)
+	}
+	var login string
+	if err := target.QueryRow("SELECT user_login FROM users WHERE user_id = 2").Scan(&login); err != nil || login != "hubot" {
+		t.Errorf("want user 2 migrated by retry, got %q, %v", login, err)
+	}
+	assertLedger(t, target, "migrate-users", 3)
+}
+
+func TestFailureRetrySequence(t *testing.T) {
+	target := openTarget(t)
+
+	const stmt = "INSERT INTO restarts (value) VALUES (%d)"
+	if _, err := target.Exec("CREATE TABLE restarts (value INTEGER)"); err != nil {
+		t.Fatal(err)
+	}
+
+	task, err := beginTask(target, "migrate-builds", Options{Retry: []int64{12}, Report: new(Report)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := task.begin(); err != nil {
+		t.Fatal(err)
+	}
+	defer task.tx.Rollback()
+
+	meddler.Default = meddler.PostgreSQL
+	defer func() { meddler.Default = meddler.SQLite }()
+
+	// the retried rows are not the highest migrated rows, and
+	// the sequence is therefore not restarted.
+	task.track(12)
+	if err := task.resetSequence(stmt); err != nil {
+		t.Fatal(err)
+	}
+	if got := restarts(t, task); len(got) != 0 {
+		t.Errorf("want sequence not restarted by retry, got %v", got)
+	}
+
+	task.failures.retry = nil
+	if err := task.resetSequence(stmt); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := restarts(t, task), []int64{12}; !reflect.DeepEqual(got, want) {
+		t.Errorf("want sequence restarted after %v, got %v", want, got)
+	}
+}
+
+// helper function asserts the last identifier recorded in the
+// ledger of the step.
+func assertLedger(t *testing.T, target *sql.DB, step string, want int64) {
+	t.Helper()
+	ledger, err := findLedger(target, step)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ledger.LastID != want {
+		t.Errorf("%s: want ledger after %d, got %d", step, want, ledger.LastID)
+	}
+}
@@ -0,0 +1,194 @@
+package migrate
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/russross/meddler"
+	"github.com/sirupsen/logrus"
+)
+
+// Ledger status values.
+const (
+	StatusRunning = "running"
+	StatusSuccess = "success"
+	StatusFailure = "failure"
+)
+
+// Ledger records the progress of a migration step in the
+// target database. The last identifier is the highest source
+// identifier committed to the target database, and is used
+// to resume the step where the previous run stopped.
+type Ledger struct {
+	Step     string `meddler:"ledger_step"`
+	Status   string `meddler:"ledger_status"`
+	Rows     int64  `meddler:"ledger_rows"`
+	LastID   int64  `meddler:"ledger_last_id"`
+	Error    string `meddler:"ledger_error"`
+	Started  int64  `meddler:"ledger_started"`
+	Finished int64  `meddler:"ledger_finished"`
+}
+
+// ListLedger returns the ledger entries for all migration
+// steps that have been executed against the target database.
+func ListLedger(target *sql.DB) ([]*Ledger, error) {
+	ledgers := []*Ledger{}
+	err := meddler.QueryAll(target, &ledgers, ledgerListQuery)
+	return ledgers, err
+}
+
+// ResetLedger removes the ledger entry for the named step so
+// that the next run starts from the beginning. Note that rows
+// already copied to the target database are not removed.
+func ResetLedger(target *sql.DB, step string) error {
+	_, err := target.Exec(rebind(ledgerDeleteStmt), step)
+	return err
+}
+
+// helper function loads the ledger entry for the named step.
+// If the step has never been executed an empty entry is
+// returned.
+func findLedger(db *sql.DB, step string) (*Ledger, error) {
+	ledger := &Ledger{}
+	err := meddler.QueryRow(db, ledger, rebind(ledgerFindQuery), step)
+	if err == sql.ErrNoRows {
+		return &Ledger{Step: step}, nil
+	}
+	return ledger, err
+}
+
+// helper function loads the ledger entry for the named step,
+// creating the entry if it does not exist, and marks the step
+// as running.
+func beginLedger(db *sql.DB, step string) (*Ledger, error) {
+	ledger, err := findLedger(db, step)
+	if err != nil {
+		return nil, err
+	}
+	if ledger.Status == "" {
+		ledger.Status = StatusRunning
+		ledger.Started = time.Now().Unix()
+		return ledger, meddler.Insert(db, "migrate_ledger", ledger)
+	}
+
+	if ledger.LastID > 0 {
+		logrus.WithField("step", step).
+			Infof("resuming after source id %d", ledger.LastID)
+	}
+
+	ledger.Status = StatusRunning
+	ledger.Error = ""
+	ledger.Started = time.Now().Unix()
+	ledger.Finished = 0
+	return ledger, saveLedger(db, ledger)
+}
+
+// helper function loads the ledger entry for the named step,
+// and marks the step as running. In dry run mode the ledger
+// is loaded but never written.
+func startLedger(db *sql.DB, step string, opts Options) (*Ledger, error) {
+	if opts.DryRun {
+		return findLedger(db, step)
+	}
+	return beginLedger(db, step)
+}
+
+// helper function saves the progress of the step. This should
+// be executed in the same transaction as the migrated rows, so
+// that the ledger never gets ahead of the target database.
+func saveLedger(db meddler.DB, ledger *Ledger) error {
+	_, err := db.Exec(rebind(ledgerUpdateStmt),
+		ledger.Status,
+		ledger.Rows,
+		ledger.LastID,
+		ledger.Error,
+		ledger.Started,
+		ledger.Finished,
+		ledger.Step,
+	)
+	return err
+}
+
+// helper function marks the step as successful.
+func finishLedger(db meddler.DB, ledger *Ledger) error {
+	ledger.Status = StatusSuccess
+	ledger.Finished = time.Now().Unix()
+	return saveLedger(db, ledger)
+}
+
+// helper function marks the step as failed if err is not nil.
+// Only the status is updated, since the progress recorded in
+// the failed transaction was rolled back.
+func failLedger(db *sql.DB, ledger *Ledger, err error) {
+	if err == nil {
+		return
+	}
+	_, dberr := db.Exec(rebind(ledgerFailStmt),
+		StatusFailure,
+		err.Error(),
+		time.Now().Unix(),
+		ledger.Step,
+	)
+	if dberr != nil {
+		logrus.WithError(dberr).
+			WithField("step", ledger.Step).
+			Errorln("cannot update ledger")
+	}
+}
+
+// helper function rewrites ? bind variables to the $n
+// format used by postgres.
+func rebind(query string) string {
+	if meddler.Default != meddler.PostgreSQL {
+		return query
+	}
+	parts := strings.Split(query, "?")
+	var b strings.Builder
+	for i, part := range parts {
+		b.WriteString(part)
+		if i < len(parts)-1 {
+			b.WriteString("$" + strconv.Itoa(i+1))
+		}
+	}
+	return b.String()
+}
+
+const ledgerListQuery = `
+SELECT *
+FROM migrate_ledger
+ORDER BY ledger_started
+`
+
+const ledgerFindQuery = `
+SELECT *
+FROM migrate_ledger
+WHERE ledger_step = ?
+`
+
+const ledgerUpdateStmt = `
+UPDATE migrate_ledger
+SET
+ ledger_status = ?
+,ledger_rows = ?
+,ledger_last_id = ?
+,ledger_error = ?
+,ledger_started = ?
+,ledger_finished = ?
+WHERE ledger_step = ?
+`
+
+const ledgerFailStmt = `
+UPDATE migrate_ledger
+SET
+ ledger_status = ?
+,ledger_error = ?
+,ledger_finished = ?
+WHERE ledger_step = ?
+`
+
+const ledgerDeleteStmt = `
+DELETE FROM migrate_ledger
+WHERE ledger_step = ?
+`
@@ -0,0 +1,264 @@
+package migrate
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/drone/drone-migrate/migrate/db"
+	"github.com/russross/meddler"
+)
+
+// helper function opens an in-memory sqlite database with the
+// 1.x schema and the migration tables.
+func openTarget(t *testing.T) *sql.DB {
+	t.Helper()
+	target, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Create(target, "sqlite3"); err != nil {
+		t.Fatal(err)
+	}
+	dialect := meddler.Default
+	meddler.Default = meddler.SQLite
+	t.Cleanup(func() {
+		meddler.Default = dialect
+		target.Close()
+	})
+	return target
+}
+
+// helper function opens an in-memory sqlite database with the
+// 0.x schema.
+func openSource(t *testing.T) *sql.DB {
+	t.Helper()
+	source, err := sql.Open("sqlite3", fmt.Sprintf("file:%s_source?mode=memory&cache=shared", t.Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := source.Exec(sourceSchema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { source.Close() })
+	return source
+}
+
+// helper function executes the statements in the database.
+func execAll(t *testing.T, db *sql.DB, stmts ...string) {
+	t.Helper()
+	for _, stmt := range stmts {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("%s: %s", stmt, err)
+		}
+	}
+}
+
+func TestRebind(t *testing.T) {
+	tests := []struct {
+		dialect *meddler.Database
+		query   string
+		want    string
+	}{
+		{meddler.PostgreSQL, "SELECT 1", "SELECT 1"},
+		{meddler.PostgreSQL, "WHERE a = ?", "WHERE a = $1"},
+		{meddler.PostgreSQL, "SET a = ?, b = ? WHERE c = ?", "SET a = $1, b = $2 WHERE c = $3"},
+		{meddler.MySQL, "SET a = ?, b = ?", "SET a = ?, b = ?"},
+		{meddler.SQLite, "SET a = ?, b = ?", "SET a = ?, b = ?"},
+	}
+	dialect := meddler.Default
+	defer func() { meddler.Default = dialect }()
+	for _, test := range tests {
+		meddler.Default = test.dialect
+		if got := rebind(test.query); got != test.want {
+			t.Errorf("rebind %q: want %q, got %q", test.query, test.want, got)
+		}
+	}
+}
+
+func TestLedgerResume(t *testing.T) {
+	target := openTarget(t)
+
+	ledger, err := beginLedger(target, "migrate-builds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ledger.Status != StatusRunning || ledger.LastID != 0 {
+		t.Errorf("want new running step, got status %s, last id %d", ledger.Status, ledger.LastID)
+	}
+
+	// the progress of a committed batch is kept when the step
+	// fails, and the step resumes after it.
+	ledger.Rows = 10
+	ledger.LastID = 42
+	if err := saveLedger(target, ledger); err != nil {
+		t.Fatal(err)
+	}
+	failLedger(target, ledger, errors.New("connection reset"))
+
+	ledger, err = findLedger(target, "migrate-builds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ledger.Status != StatusFailure || ledger.Error != "connection reset" {
+		t.Errorf("want failed step, got status %s, error %q", ledger.Status, ledger.Error)
+	}
+
+	ledger, err = beginLedger(target, "migrate-builds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ledger.Status != StatusRunning || ledger.Error != "" {
+		t.Errorf("want resumed running step, got status %s, error %q", ledger.Status, ledger.Error)
+	}
+	if ledger.LastID != 42 || ledger.Rows != 10 {
+		t.Errorf("want resume after id 42 with 10 rows, got id %d with %d rows", ledger.LastID, ledger.Rows)
+	}
+
+	task, err := beginTask(target, "migrate-builds", Options{Report: new(Report)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := task.after(); got != 42 {
+		t.Errorf("want task to resume after id 42, got %d", got)
+	}
+
+	if err := finishLedger(target, ledger); err != nil {
+		t.Fatal(err)
+	}
+	if err := ResetLedger(target, "migrate-builds"); err != nil {
+		t.Fatal(err)
+	}
+	ledger, err = findLedger(target, "migrate-builds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ledger.Status != "" || ledger.LastID != 0 {
+		t.Errorf("want reset step, got status %s, last id %d", ledger.Status, ledger.LastID)
+	}
+}
+
+// sourceSchema is the subset of the 0.x sqlite schema read by
+// the migration. Columns default to zero values, so that the
+// tests only insert the columns they use.
+const sourceSchema = `
+CREATE TABLE users (
+ user_id     INTEGER PRIMARY KEY AUTOINCREMENT
+,user_login  TEXT NOT NULL DEFAULT ''
+,user_token  TEXT NOT NULL DEFAULT ''
+,user_secret TEXT NOT NULL DEFAULT ''
+,user_expiry INTEGER NOT NULL DEFAULT 0
+,user_email  TEXT NOT NULL DEFAULT ''
+,user_avatar TEXT NOT NULL DEFAULT ''
+,user_active BOOLEAN NOT NULL DEFAULT 0
+,user_admin  BOOLEAN NOT NULL DEFAULT 0
+,user_synced INTEGER NOT NULL DEFAULT 0
+,user_hash   TEXT NOT NULL DEFAULT ''
+,UNIQUE(user_login)
+);
+
+CREATE TABLE repos (
+ repo_id            INTEGER PRIMARY KEY AUTOINCREMENT
+,repo_user_id       INTEGER NOT NULL DEFAULT 0
+,repo_owner         TEXT NOT NULL DEFAULT ''
+,repo_name          TEXT NOT NULL DEFAULT ''
+,repo_full_name     TEXT NOT NULL DEFAULT ''
+,repo_avatar        TEXT NOT NULL DEFAULT ''
+,repo_link          TEXT NOT NULL DEFAULT ''
+,repo_scm           TEXT NOT NULL DEFAULT ''
+,repo_clone         TEXT NOT NULL DEFAULT ''
+,repo_branch        TEXT NOT NULL DEFAULT ''
+,repo_timeout       INTEGER NOT NULL DEFAULT 0
+,repo_visibility    TEXT NOT NULL DEFAULT ''
+,repo_private       BOOLEAN NOT NULL DEFAULT 0
+,repo_trusted       BOOLEAN NOT NULL DEFAULT 0
+,repo_gated         BOOLEAN NOT NULL DEFAULT 0
+,repo_active        BOOLEAN NOT NULL DEFAULT 0
+,repo_allow_pr      BOOLEAN NOT NULL DEFAULT 0
+,repo_allow_push    BOOLEAN NOT NULL DEFAULT 0
+,repo_allow_deploys BOOLEAN NOT NULL DEFAULT 0
+,repo_allow_tags    BOOLEAN NOT NULL DEFAULT 0
+,repo_counter       INTEGER NOT NULL DEFAULT 0
+,repo_config_path   TEXT NOT NULL DEFAULT ''
+,repo_hash          TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE builds (
+ build_id        INTEGER PRIMARY KEY AUTOINCREMENT
+,build_repo_id   INTEGER NOT NULL DEFAULT 0
+,build_config_id INTEGER NOT NULL DEFAULT 0
+,build_number    INTEGER NOT NULL DEFAULT 0
+,build_parent    INTEGER NOT NULL DEFAULT 0
+,build_event     TEXT NOT NULL DEFAULT ''
+,build_status    TEXT NOT NULL DEFAULT ''
+,build_error     TEXT NOT NULL DEFAULT ''
+,build_enqueued  INTEGER NOT NULL DEFAULT 0
+,build_created   INTEGER NOT NULL DEFAULT 0
+,build_started   INTEGER NOT NULL DEFAULT 0
+,build_finished  INTEGER NOT NULL DEFAULT 0
+,build_deploy    TEXT NOT NULL DEFAULT ''
+,build_commit    TEXT NOT NULL DEFAULT ''
+,build_branch    TEXT NOT NULL DEFAULT ''
+,build_ref       TEXT NOT NULL DEFAULT ''
+,build_refspec   TEXT NOT NULL DEFAULT ''
+,build_remote    TEXT NOT NULL DEFAULT ''
+,build_title     TEXT NOT NULL DEFAULT ''
+,build_message   TEXT NOT NULL DEFAULT ''
+,build_timestamp INTEGER NOT NULL DEFAULT 0
+,build_sender    TEXT NOT NULL DEFAULT ''
+,build_author    TEXT NOT NULL DEFAULT ''
+,build_avatar    TEXT NOT NULL DEFAULT ''
+,build_email     TEXT NOT NULL DEFAULT ''
+,build_link      TEXT NOT NULL DEFAULT ''
+,build_signed    BOOLEAN NOT NULL DEFAULT 0
+,build_verified  BOOLEAN NOT NULL DEFAULT 0
+,build_reviewer  TEXT NOT NULL DEFAULT ''
+,build_reviewed  INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE TABLE procs (
+ proc_id        INTEGER PRIMARY KEY AUTOINCREMENT
+,proc_build_id  INTEGER NOT NULL DEFAULT 0
+,proc_pid       INTEGER NOT NULL DEFAULT 0
+,proc_ppid      INTEGER NOT NULL DEFAULT 0
+,proc_pgid      INTEGER NOT NULL DEFAULT 0
+,proc_name      TEXT NOT NULL DEFAULT ''
+,proc_state     TEXT NOT NULL DEFAULT ''
+,proc_error     TEXT NOT NULL DEFAULT ''
+,proc_exit_code INTEGER NOT NULL DEFAULT 0
+,proc_started   INTEGER NOT NULL DEFAULT 0
+,proc_stopped   INTEGER NOT NULL DEFAULT 0
+,proc_machine   TEXT NOT NULL DEFAULT ''
+,proc_platform  TEXT NOT NULL DEFAULT ''
+,proc_environ   BLOB NOT NULL DEFAULT '{}'
+);
+
+CREATE TABLE logs (
+ log_id     INTEGER PRIMARY KEY AUTOINCREMENT
+,log_job_id INTEGER NOT NULL DEFAULT 0
+,log_data   BLOB
+,UNIQUE(log_job_id)
+);
+
+CREATE TABLE secrets (
+ secret_id          INTEGER PRIMARY KEY AUTOINCREMENT
+,secret_repo_id     INTEGER NOT NULL DEFAULT 0
+,secret_name        TEXT NOT NULL DEFAULT ''
+,secret_value       TEXT NOT NULL DEFAULT ''
+,secret_images      TEXT NOT NULL DEFAULT ''
+,secret_events      TEXT NOT NULL DEFAULT '[]'
+,secret_skip_verify BOOLEAN NOT NULL DEFAULT 0
+,secret_conceal     BOOLEAN NOT NULL DEFAULT 0
+);
+
+CREATE TABLE registry (
+ registry_id       INTEGER PRIMARY KEY AUTOINCREMENT
+,registry_repo_id  INTEGER NOT NULL DEFAULT 0
+,registry_addr     TEXT NOT NULL DEFAULT ''
+,registry_email    TEXT NOT NULL DEFAULT ''
+,registry_username TEXT NOT NULL DEFAULT ''
+,registry_password TEXT NOT NULL DEFAULT ''
+,registry_token    TEXT NOT NULL DEFAULT ''
+);
+`
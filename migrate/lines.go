@@ -0,0 +1,109 @@
+package migrate
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+// Drone 0.x log line types. Only stdout and stderr lines are
+// displayed, the remaining types are discarded.
+const (
+	lineStdout = iota
+	lineStderr
+	lineExitCode
+	lineMetadata
+	lineProgress
+)
+
+// errPlainText is returned when the log payload is not json
+// encoded, and is converted line by line.
+var errPlainText = errors.New("log payload is not json encoded")
+
+// helper function converts the 0.x log payload to a json array
+// of 1.x log lines, and returns the number of lines converted.
+// The 0.x payload is a json array of lines, or a sequence of
+// json encoded lines. If the payload is malformed, the lines
+// decoded before the error are converted and returned with the
+// error. If no lines can be decoded, the payload is converted
+// as plain text.
+func convertLines(data []byte) ([]byte, int, error) {
+	linesV0, err := decodeLines(data)
+	if err != nil && len(linesV0) == 0 {
+		linesV0, err = splitLines(data), errPlainText
+	}
+
+	linesV1 := []*LineV1{}
+	for _, lineV0 := range linesV0 {
+		if lineV0.Type != lineStdout && lineV0.Type != lineStderr {
+			continue
+		}
+		linesV1 = append(linesV1, &LineV1{
+			Number:    len(linesV1),
+			Message:   lineV0.Out,
+			Timestamp: lineV0.Time,
+		})
+	}
+
+	out, merr := json.Marshal(linesV1)
+	if merr != nil {
+		return nil, 0, merr
+	}
+	return out, len(linesV1), err
+}
+
+// helper function decodes the json encoded 0.x log lines.
+func decodeLines(data []byte) ([]*LineV0, error) {
+	data = bytes.TrimSpace(data)
+	dec := json.NewDecoder(bytes.NewReader(data))
+
+	var lines []*LineV0
+	if len(data) != 0 && data[0] == '[' {
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+		for dec.More() {
+			line := new(LineV0)
+			if err := dec.Decode(line); err != nil {
+				return lines, err
+			}
+			lines = append(lines, line)
+		}
+		// a missing closing bracket indicates the payload
+		// was truncated.
+		_, err := dec.Token()
+		return lines, err
+	}
+
+	for {
+		line := new(LineV0)
+		err := dec.Decode(line)
+		if err == io.EOF {
+			return lines, nil
+		}
+		if err != nil {
+			return lines, err
+		}
+		lines = append(lines, line)
+	}
+}
+
+// helper function splits a plain text payload into lines.
+func splitLines(data []byte) []*LineV0 {
+	var lines []*LineV0
+	reader := bufio.NewReader(bytes.NewReader(data))
+	for {
+		out, err := reader.ReadString('\n')
+		if len(out) != 0 {
+			lines = append(lines, &LineV0{
+				Pos: len(lines),
+				Out: out,
+			})
+		}
+		if err != nil {
+			return lines
+		}
+	}
+}
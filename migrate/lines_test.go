@@ -0,0 +1,91 @@
+package migrate
+
+import "testing"
+
+func TestConvertLines(t *testing.T) {
+	tests := []struct {
+		data      string
+		want      string
+		lines     int
+		err       error
+		malformed bool
+	}{
+		{
+			data: "",
+			want: `[]`,
+		},
+		{
+			data: `[]`,
+			want: `[]`,
+		},
+		{
+			data:  `[{"proc":"build","time":1,"type":0,"pos":0,"out":"go build\n"},{"proc":"build","type":2,"out":"0"},{"proc":"build","time":2,"type":1,"pos":1,"out":"error\n"}]`,
+			want:  `[{"pos":0,"out":"go build\n","time":1},{"pos":1,"out":"error\n","time":2}]`,
+			lines: 2,
+		},
+		{
+			data:  "{\"proc\":\"build\",\"out\":\"go build\\n\"}\n{\"proc\":\"build\",\"time\":3,\"type\":4,\"out\":\"50%\"}\n{\"proc\":\"build\",\"time\":4,\"out\":\"go test\\n\"}\n",
+			want:  `[{"pos":0,"out":"go build\n","time":0},{"pos":1,"out":"go test\n","time":4}]`,
+			lines: 2,
+		},
+		{
+			data:      `[{"out":"go build\n"},{"out":"go te`,
+			want:      `[{"pos":0,"out":"go build\n","time":0}]`,
+			lines:     1,
+			malformed: true,
+		},
+		{
+			data:      `[{"out":"go build\n"}`,
+			want:      `[{"pos":0,"out":"go build\n","time":0}]`,
+			lines:     1,
+			malformed: true,
+		},
+		{
+			data:  "go build\ngo test",
+			want:  `[{"pos":0,"out":"go build\n","time":0},{"pos":1,"out":"go test","time":0}]`,
+			lines: 2,
+			err:   errPlainText,
+		},
+	}
+	for _, test := range tests {
+		got, lines, err := convertLines([]byte(test.data))
+		switch {
+		case test.malformed && (err == nil || err == errPlainText):
+			t.Errorf("%q: want decode error, got %v", test.data, err)
+		case !test.malformed && err != test.err:
+			t.Errorf("%q: want error %v, got %v", test.data, test.err, err)
+		}
+		if string(got) != test.want {
+			t.Errorf("%q: want %s, got %s", test.data, test.want, got)
+		}
+		if lines != test.lines {
+			t.Errorf("%q: want %d lines, got %d", test.data, test.lines, lines)
+		}
+	}
+}
+
+func TestDecodeLines(t *testing.T) {
+	tests := []struct {
+		data  string
+		lines int
+		err   bool
+	}{
+		{data: "", lines: 0},
+		{data: "  \n", lines: 0},
+		{data: `[{"out":"a"},{"out":"b"}]`, lines: 2},
+		{data: "\n [{\"out\":\"a\"}] \n", lines: 1},
+		{data: `{"out":"a"}{"out":"b"}{"out":"c"}`, lines: 3},
+		{data: `{"out":"a"}{"out":`, lines: 1, err: true},
+		{data: `[{"out":"a"},`, lines: 1, err: true},
+		{data: `plain text`, lines: 0, err: true},
+	}
+	for _, test := range tests {
+		lines, err := decodeLines([]byte(test.data))
+		if test.err != (err != nil) {
+			t.Errorf("%q: want error %v, got %v", test.data, test.err, err)
+		}
+		if len(lines) != test.lines {
+			t.Errorf("%q: want %d lines, got %d", test.data, test.lines, len(lines))
+		}
+	}
+}
@@ -1,130 +1,241 @@
 package migrate
 
 import (
-	"bytes"
 	"database/sql"
 	"fmt"
 	"path"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
-	"github.com/russross/meddler"
 	"github.com/sirupsen/logrus"
 )
 
-// MigrateLogs migrates the steps from the V0
-// database to the V1 database.
-func MigrateLogs(source, target *sql.DB) error {
-	stepsV0 := []*StepV0{}
+// MigrateLogs migrates the logs from the V0 database to the
+// log sink. The progress is recorded in the V1 database ledger,
+// and the migration resumes after the last recorded step. Logs
+// that have already been written to the sink are skipped.
+func MigrateLogs(source, target *sql.DB, sink LogSink, opts Options) (err error) {
+	defer closeSink(sink, &err)
 
-	// 1. load all stages from the V0 database.
-	err := meddler.QueryAll(source, &stepsV0, stepListQueryLogs)
-	if err != nil {
-		return err
+	step := "migrate-logs"
+	if name := sink.Name(); name != "db" {
+		step = step + "-" + name
 	}
 
-	logrus.Infof("migrating %d logs", len(stepsV0))
-
-	// 2. create a database transaction so that we
-	// can rollback if the data migration fails.
-	tx, err := target.Begin()
+	// the ledger is not written in dry run mode, or when
+	// failed steps are retried.
+	var ledger *Ledger
+	if opts.DryRun || opts.Retry != nil {
+		ledger, err = findLedger(target, step)
+	} else {
+		ledger, err = beginLedger(target, step)
+	}
 	if err != nil {
 		return err
 	}
-	defer tx.Rollback()
-
-	// 3. iterate through the list and convert from
-	// the 0.x to the 1.x structure and insert.
-	for _, stepV0 := range stepsV0 {
-		logsV0 := &LogsV0{}
-		err := meddler.QueryRow(source, logsV0, fmt.Sprintf("select * from logs where log_job_id = %d", stepV0.ID))
-		if err == sql.ErrNoRows {
-			continue
+	report := opts.step(step)
+	failures := newFailureLog(step, opts, report, ErrorAbort)
+	defer func() {
+		if err != nil && !failures.aborted {
+			report.fail(err.Error())
 		}
-		if err != nil {
-			logrus.WithError(err).Warnf("cannot find logs for step: id: %d", stepV0.ID)
-			continue
+		report.finish()
+		if !opts.DryRun && !failures.retrying() {
+			failLedger(target, ledger, err)
 		}
+	}()
+	switch {
+	case failures.retrying():
+		ledger.LastID = failures.after()
+	case opts.ResumeLogs != 0:
+		logrus.Infof("resuming after step id %d", opts.ResumeLogs)
+		ledger.LastID = opts.ResumeLogs
+	}
 
-		logsV1 := &LogsV1{
-			ID:   logsV0.ProcID,
-			Data: logsV0.Data,
+	// when the step is synced, the logs of the steps that were
+	// running or completed since the previous run are written
+	// again. The watermark is not advanced when a previous run
+	// is resumed without syncing, see task.mark.
+	var synced, previous, watermark int64
+	if !failures.retrying() {
+		if opts.Sync && opts.ResumeLogs == 0 {
+			synced = ledger.LastID
 		}
-
-		err = meddler.Insert(tx, "logs", logsV1)
+		previous, err = findWatermark(target, step)
 		if err != nil {
-			logrus.WithError(err).Errorln("migration failed")
 			return err
 		}
+		watermark = previous
+		if ledger.LastID == 0 || synced > 0 {
+			watermark, err = readWatermark(source, procWatermarkQuery)
+			if err != nil {
+				return err
+			}
+		}
 	}
 
-	logrus.Infof("migration complete")
-	return tx.Commit()
-}
-
-// MigrateLogsS3 migrates the steps from the V0 database to S3.
-func MigrateLogsS3(source *sql.DB, bucket, prefix string, resume int64) error {
-	stepsV0 := []*StepV0{}
+	logrus.WithField("sink", sink.Name()).Infoln("migrating logs")
+	if failures.retrying() {
+		report.expect(failures.expected(0))
+	} else {
+		report.expect(countRows(source, stepCountQueryLogs, ledger.LastID))
+	}
+	if synced > 0 {
+		logrus.WithField("step", step).
+			Infof("syncing logs changed after watermark %d", previous)
+		report.expect(report.expected + countRows(source, fmt.Sprintf(stepChangedCountQueryLogs, synced, previous), 0))
+	}
 
-	// 1. load all stages from the V0 database.
-	err := meddler.QueryAll(source, &stepsV0, stepListQueryLogs)
-	if err != nil {
-		return err
+	// 1. iterate through the V0 steps one page at a
+	// time, and fetch, convert and write the logs with a
+	// pool of workers. logs that exist in the sink with the same
+	// size were written by a previous run, and are skipped.
+	stats := newThroughput()
+	produce := func(submit func(*StepV0) error) error {
+		scan := func(rows *sql.Rows) (int64, error) {
+			stepV0 := &StepV0{}
+			if err := scanRow(rows, stepV0); err != nil {
+				return 0, err
+			}
+			if !failures.selected(stepV0.ID) {
+				return stepV0.ID, nil
+			}
+			return stepV0.ID, submit(stepV0)
+		}
+		if synced > 0 {
+			query := fmt.Sprintf(stepChangedQueryLogs, synced, previous)
+			if err := paginate(source, query, 0, opts.pageSize(), scan); err != nil {
+				return err
+			}
+		}
+		return paginate(source, stepListQueryLogs, ledger.LastID, opts.pageSize(), scan)
 	}
+	work := func(job *logJob) {
+		job.fetch(source)
+		if job.err != nil || job.logs == nil || len(job.logs.Data) == 0 {
+			return
+		}
+		job.data, job.lines, job.convErr = convertLines(job.logs.Data)
+		if job.data == nil {
+			job.err = job.convErr
+			return
+		}
 
-	logrus.Infof("migrating %d logs", len(stepsV0))
+		job.exists, job.err = sink.Exists(job.logs.ProcID, len(job.data))
+		if job.err != nil || job.exists || opts.DryRun {
+			return
+		}
 
-	// 2. create the s3 client
-	sess := session.Must(
-		session.NewSession(&aws.Config{
-			// Endpoint:         aws.String(endpoint),
-			// DisableSSL:       aws.Bool(disableSSL),
-			// S3ForcePathStyle: aws.Bool(pathStyle),
-		}),
-	)
+		logrus.Debugf("writing logs for step: %d", job.step.ID)
+		job.err = sink.Write(job.logs.ProcID, job.data)
+	}
 
-	// 3. iterate through the list and convert from
-	// the 0.x to the 1.x structure and insert.
-	for i, stepV0 := range stepsV0 {
-		logsV0 := &LogsV0{}
-		err := meddler.QueryRow(source, logsV0, fmt.Sprintf("select * from logs where log_job_id = %d", stepV0.ID))
-		if err == sql.ErrNoRows {
-			continue
+	// 2. complete the jobs in order, so that the logs of
+	// every step up to and including the last completed
+	// step have been written, and it is therefore a safe
+	// resume point. The sink is flushed, and the resume
+	// point and failed steps recorded, once per batch.
+	var pending int
+	batch := opts.batchSize(step)
+	checkpoint := func() error {
+		if opts.DryRun {
+			return nil
 		}
-		if err != nil {
-			logrus.WithError(err).Warnf("cannot find logs for step: id: %d", stepV0.ID)
-			continue
+		pending = 0
+		if s, ok := sink.(ledgerSink); ok && !failures.retrying() {
+			if err := s.flushLedger(ledger); err != nil {
+				return err
+			}
+			return failures.flush(target)
+		}
+		if err := sink.Flush(); err != nil {
+			return err
 		}
-		if len(logsV0.Data) == 0 {
-			logrus.WithError(err).Warnf("skipping empty logs for step: id: %d", stepV0.ID)
-			continue
+		if err := failures.flush(target); err != nil {
+			return err
 		}
-		if resume >= stepV0.ID {
-			continue
+		if failures.retrying() {
+			return nil
 		}
+		return saveLedger(target, ledger)
+	}
+	complete := func(job *logJob) error {
+		report.Read++
+		report.advance()
 
-		logrus.Debugf("uploading logs for step: %d", stepV0.ID)
+		log := logrus.WithField("step", job.step.ID)
+		switch {
+		case job.err != nil:
+			if err := failures.fail(job.step.ID, "migration failed", job.err, log); err != nil {
+				return err
+			}
+		case job.logs == nil:
+		case len(job.logs.Data) == 0:
+			report.Skipped++
+			report.Warnings["skipping empty logs for step"]++
+			log.Warnln("skipping empty logs for step")
+		case job.exists:
+			report.Skipped++
+			report.Warnings["logs already exist"]++
+			log.Debugln("logs already exist")
+		default:
+			report.Inserted++
+			ledger.Rows++
+			stats.add(len(job.data), 1000)
+		}
 
-		uploader := s3manager.NewUploader(sess)
-		input := &s3manager.UploadInput{
-			ACL:    aws.String("private"),
-			Bucket: aws.String(bucket),
-			Key:    aws.String(s3key(prefix, logsV0.ProcID)),
-			Body:   bytes.NewBuffer(logsV0.Data),
+		switch {
+		case job.convErr == errPlainText:
+			report.Warnings["logs converted from plain text"]++
+			log.Debugln("logs converted from plain text")
+		case job.convErr != nil:
+			report.Warnings["logs malformed, partially converted"]++
+			log.WithError(job.convErr).Warnln("logs malformed, partially converted")
 		}
-		_, err = uploader.Upload(input)
-		if err != nil {
-			logrus.WithError(err).Errorln("migration failed")
-			return err
+		if job.data != nil {
+			report.Lines += int64(job.lines)
+			log.Debugf("converted %d log lines", job.lines)
 		}
-		if i%1000 == 0 {
-			logrus.Infof("uploaded: %d", stepV0.ID)
+		if job.err == nil && failures.retrying() {
+			failures.resolve(job.step.ID)
 		}
+
+		if job.step.ID > ledger.LastID {
+			ledger.LastID = job.step.ID
+		}
+		pending++
+		if batch <= 0 || pending < batch {
+			return nil
+		}
+		return checkpoint()
+	}
+	err = runLogWorkers(opts.logWorkers(), produce, work, complete)
+	if err != nil {
+		// record the last completed step, since the recorded
+		// resume point may be behind.
+		if cerr := checkpoint(); cerr != nil {
+			logrus.WithError(cerr).Errorln("cannot update ledger")
+		}
+		return err
 	}
 
+	if err := checkpoint(); err != nil {
+		return err
+	}
+	stats.log()
+	logrus.Infof("migrated logs for %d steps, %d lines", report.Inserted, report.Lines)
+
+	if opts.DryRun {
+		logrus.WithField("step", step).
+			Infoln("dry run: logs not written")
+		return nil
+	}
 	logrus.Infof("migration complete")
-	return nil
+	if failures.retrying() {
+		return nil
+	}
+	if err := finishLedger(target, ledger); err != nil {
+		return err
+	}
+	return saveWatermark(target, step, watermark)
 }
 
 func s3key(prefix string, step int64) string {
@@ -138,5 +249,43 @@ INNER JOIN builds ON procs.proc_build_id = builds.build_id
 INNER JOIN repos ON builds.build_repo_id = repos.repo_id
 WHERE proc_ppid != 0
   AND repo_user_id > 0
+  AND proc_id > %d
 ORDER BY proc_id ASC
+LIMIT %d
+`
+
+const stepCountQueryLogs = `
+SELECT COUNT(*)
+FROM procs
+INNER JOIN builds ON procs.proc_build_id = builds.build_id
+INNER JOIN repos ON builds.build_repo_id = repos.repo_id
+WHERE proc_ppid != 0
+  AND repo_user_id > 0
+  AND proc_id > %d
+`
+
+const stepChangedQueryLogs = `
+SELECT procs.*
+FROM procs
+INNER JOIN builds ON procs.proc_build_id = builds.build_id
+INNER JOIN repos ON builds.build_repo_id = repos.repo_id
+WHERE proc_ppid != 0
+  AND repo_user_id > 0
+  AND proc_id > %%d
+  AND proc_id <= %d
+  AND (proc_stopped = 0 OR proc_stopped > %d)
+ORDER BY proc_id ASC
+LIMIT %%d
+`
+
+const stepChangedCountQueryLogs = `
+SELECT COUNT(*)
+FROM procs
+INNER JOIN builds ON procs.proc_build_id = builds.build_id
+INNER JOIN repos ON builds.build_repo_id = repos.repo_id
+WHERE proc_ppid != 0
+  AND repo_user_id > 0
+  AND proc_id > %%d
+  AND proc_id <= %d
+  AND (proc_stopped = 0 OR proc_stopped > %d)
 `
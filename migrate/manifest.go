@@ -0,0 +1,75 @@
+package migrate
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+// manifestEntry records an object written to a log sink.
+type manifestEntry struct {
+	Step     int64  `json:"step"`
+	Key      string `json:"key"`
+	Size     int    `json:"size"`
+	Encoding string `json:"encoding,omitempty"`
+	MD5      string `json:"md5"`
+	SHA256   string `json:"sha256"`
+}
+
+// manifest writes the objects written to a log sink to a
+// file, one json encoded entry per line. The file is appended
+// to, so that a resumed migration extends the manifest.
+type manifest struct {
+	sync.Mutex
+	file *os.File
+	buf  *bufio.Writer
+}
+
+// helper function opens the manifest file for appending.
+func openManifest(path string) (*manifest, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &manifest{
+		file: file,
+		buf:  bufio.NewWriter(file),
+	}, nil
+}
+
+// helper function appends the entry to the manifest.
+func (m *manifest) add(entry *manifestEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	m.Lock()
+	defer m.Unlock()
+	if _, err := m.buf.Write(data); err != nil {
+		return err
+	}
+	return m.buf.WriteByte('\n')
+}
+
+// helper function writes the buffered entries to disk. The
+// manifest is flushed before the progress is recorded, so
+// that every recorded log is listed in the manifest.
+func (m *manifest) flush() error {
+	m.Lock()
+	defer m.Unlock()
+	if err := m.buf.Flush(); err != nil {
+		return err
+	}
+	return m.file.Sync()
+}
+
+// helper function writes the buffered entries to disk, and
+// closes the manifest file.
+func (m *manifest) close() error {
+	err := m.flush()
+	if cerr := m.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,269 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/drone/go-scm/scm"
+	"github.com/russross/meddler"
+	"github.com/sirupsen/logrus"
+)
+
+// MergeRenamed merges repositories that have been renamed
+// into the repository with the new name. The builds, stages
+// and secrets of the stale repository are moved to the new
+// repository and the stale repository is removed. Steps and
+// logs reference their stage and step, and are therefore
+// moved with the build.
+func MergeRenamed(db *sql.DB, client *scm.Client, opts Options) (err error) {
+	ledger, err := startLedger(db, "merge-renamed", opts)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if !opts.DryRun {
+			failLedger(db, ledger, err)
+		}
+	}()
+
+	report := opts.step("merge-renamed")
+	failures := newFailureLog("merge-renamed", opts, report, ErrorSkip)
+	defer func() {
+		if err := failures.flush(db); err != nil {
+			logrus.WithError(err).Errorln("cannot update failure ledger")
+		}
+		report.finish()
+	}()
+
+	repos := []*RepoV1{}
+
+	if err := meddler.QueryAll(db, &repos, repoTempQuery); err != nil {
+		return err
+	}
+	report.expect(failures.expected(int64(len(repos))))
+
+	logrus.Infoln("merging renamed repositories")
+
+	for _, repo := range repos {
+		if !failures.selected(repo.ID) {
+			continue
+		}
+		report.Read++
+		report.advance()
+
+		log := logrus.WithFields(logrus.Fields{
+			"repo": repo.Slug,
+		})
+
+		user := &UserV1{}
+
+		if err := meddler.QueryRow(db, user, fmt.Sprintf(userIdentifierQuery, repo.UserID)); err != nil {
+			if err := failures.fail(repo.ID, "failed to get repository owner", err, log); err != nil {
+				return err
+			}
+			continue
+		}
+
+		log = log.WithField("owner", user.Login)
+
+		tok := &scm.Token{
+			Token:   user.Token,
+			Refresh: user.Refresh,
+		}
+		if user.Expiry > 0 {
+			tok.Expires = time.Unix(user.Expiry, 0)
+		}
+		ctx := scm.WithContext(context.Background(), tok)
+
+		remoteRepo, _, err := client.Repositories.Find(ctx, scm.Join(repo.Namespace, repo.Name))
+
+		if err != nil {
+			if err := failures.fail(repo.ID, "failed to get remote repository", err, log); err != nil {
+				return err
+			}
+			continue
+		}
+
+		remoteName := scm.Join(remoteRepo.Namespace, remoteRepo.Name)
+		if remoteName == repo.Slug {
+			log.Debugln("skip repository, found in remote system")
+			report.Skipped++
+			continue
+		}
+
+		log = log.WithField("renamed", remoteName)
+
+		survivor := &RepoV1{}
+		if err := meddler.QueryRow(db, survivor, rebind(repoSlugMergeQuery), remoteName); err != nil {
+			log.WithError(err).Warnln("skip repository, renamed repository not found")
+			report.Skipped++
+			report.Warnings["renamed repository not found"]++
+			continue
+		}
+
+		renumbered, err := mergeRepo(db, repo, survivor, opts.DryRun, log)
+		if err != nil {
+			if err := failures.fail(repo.ID, "failed to merge repository", err, log); err != nil {
+				return err
+			}
+			continue
+		}
+		if renumbered != 0 {
+			report.Warnings["builds renumbered"] += renumbered
+		}
+
+		ledger.Rows++
+		report.Deleted++
+		failures.resolve(repo.ID)
+		log.Debugln("renamed repository merged")
+	}
+
+	if !opts.DryRun {
+		if err := finishLedger(db, ledger); err != nil {
+			return err
+		}
+	}
+
+	logrus.Infoln("repository merge complete")
+	return nil
+}
+
+// helper function moves the builds, stages and secrets from
+// the stale repository to the surviving repository in a single
+// transaction, and returns the number of renumbered builds.
+// Builds are renumbered after the last build of the surviving
+// repository to keep build numbers unique, which changes the
+// links to every build of the stale repository. In dry run
+// mode the transaction is rolled back.
+func mergeRepo(db *sql.DB, stale, survivor *RepoV1, dryRun bool, log *logrus.Entry) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var last, staleLast sql.NullInt64
+	if err := tx.QueryRow(rebind(buildMaxNumberQuery), survivor.ID).Scan(&last); err != nil {
+		return 0, err
+	}
+	if err := tx.QueryRow(rebind(buildMaxNumberQuery), stale.ID).Scan(&staleLast); err != nil {
+		return 0, err
+	}
+
+	offset := survivor.Counter
+	if last.Int64 > offset {
+		offset = last.Int64
+	}
+
+	res, err := tx.Exec(rebind(buildMergeStmt), survivor.ID, offset, offset, stale.ID)
+	if err != nil {
+		return 0, err
+	}
+	renumbered, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if renumbered != 0 {
+		log.WithField("offset", offset).
+			Warnf("renumbered %d builds of renamed repository, build N is now build N+%d", renumbered, offset)
+	}
+
+	if _, err := tx.Exec(rebind(stageMergeStmt), survivor.ID, stale.ID); err != nil {
+		return 0, err
+	}
+
+	// secrets are unique per repository and name, so the
+	// secrets of the surviving repository take precedence.
+	names := map[string]bool{}
+	secrets := []*SecretV1{}
+	if err := meddler.QueryAll(tx, &secrets, rebind(secretRepoQuery), survivor.ID); err != nil {
+		return 0, err
+	}
+	for _, secret := range secrets {
+		names[secret.Name] = true
+	}
+
+	secrets = []*SecretV1{}
+	if err := meddler.QueryAll(tx, &secrets, rebind(secretRepoQuery), stale.ID); err != nil {
+		return 0, err
+	}
+	for _, secret := range secrets {
+		if names[secret.Name] {
+			log.WithField("secret", secret.Name).
+				Warnln("discard duplicate secret of renamed repository")
+			_, err = tx.Exec(rebind(secretDeleteStmt), secret.ID)
+		} else {
+			_, err = tx.Exec(rebind(secretMergeStmt), survivor.ID, secret.ID)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	counter := offset + staleLast.Int64
+	if _, err := tx.Exec(rebind(repoCounterStmt), counter, survivor.ID); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(fmt.Sprintf(deleteRepo, stale.ID)); err != nil {
+		return 0, err
+	}
+
+	if dryRun {
+		log.Infoln("dry run: rolling back repository merge")
+		return renumbered, tx.Rollback()
+	}
+	return renumbered, tx.Commit()
+}
+
+const repoSlugMergeQuery = `
+SELECT *
+FROM repos
+WHERE repo_slug = ?
+  AND repo_uid NOT LIKE 'temp_%'
+`
+
+const buildMaxNumberQuery = `
+SELECT MAX(build_number)
+FROM builds
+WHERE build_repo_id = ?
+`
+
+const buildMergeStmt = `
+UPDATE builds
+SET
+ build_repo_id = ?
+,build_number = build_number + ?
+,build_parent = CASE WHEN build_parent > 0 THEN build_parent + ? ELSE 0 END
+WHERE build_repo_id = ?
+`
+
+const stageMergeStmt = `
+UPDATE stages
+SET stage_repo_id = ?
+WHERE stage_repo_id = ?
+`
+
+const secretRepoQuery = `
+SELECT *
+FROM secrets
+WHERE secret_repo_id = ?
+`
+
+const secretMergeStmt = `
+UPDATE secrets
+SET secret_repo_id = ?
+WHERE secret_id = ?
+`
+
+const secretDeleteStmt = `
+DELETE FROM secrets
+WHERE secret_id = ?
+`
+
+const repoCounterStmt = `
+UPDATE repos
+SET repo_counter = ?
+WHERE repo_id = ?
+`
@@ -0,0 +1,128 @@
+package migrate
+
+import (
+	"database/sql"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/russross/meddler"
+	"github.com/sirupsen/logrus"
+)
+
+func TestMergeRepo(t *testing.T) {
+	target := openTarget(t)
+
+	// the surviving repository counter is greater than its last
+	// build number, since the last build was deleted.
+	survivor := &RepoV1{ID: 1, UID: "1", UserID: 1, Slug: "octocat/hello-world", Counter: 4}
+	stale := &RepoV1{ID: 2, UID: "temp_2", UserID: 1, Slug: "octocat/hello-world-old", Counter: 2}
+
+	rows := []struct {
+		table string
+		row   interface{}
+	}{
+		{"repos", survivor},
+		{"repos", stale},
+		{"builds", &BuildV1{ID: 1, RepoID: 1, Number: 1}},
+		{"builds", &BuildV1{ID: 2, RepoID: 1, Number: 2}},
+		{"builds", &BuildV1{ID: 3, RepoID: 1, Number: 3, Parent: 2}},
+		{"builds", &BuildV1{ID: 4, RepoID: 2, Number: 1}},
+		{"builds", &BuildV1{ID: 5, RepoID: 2, Number: 2, Parent: 1}},
+		{"stages", &StageV1{ID: 1, RepoID: 1, BuildID: 1, Number: 1}},
+		{"stages", &StageV1{ID: 2, RepoID: 2, BuildID: 4, Number: 1}},
+		{"stages", &StageV1{ID: 3, RepoID: 2, BuildID: 5, Number: 1}},
+		{"secrets", &SecretV1{ID: 1, RepoID: 1, Name: "password", Data: "new"}},
+		{"secrets", &SecretV1{ID: 2, RepoID: 2, Name: "password", Data: "old"}},
+		{"secrets", &SecretV1{ID: 3, RepoID: 2, Name: "token", Data: "token"}},
+	}
+	for _, row := range rows {
+		if err := meddler.Insert(target, row.table, row.row); err != nil {
+			t.Fatalf("insert %s: %s", row.table, err)
+		}
+	}
+
+	before := mergeState(t, target)
+	log := logrus.WithField("repo", stale.Slug)
+
+	// in dry run mode the merge is rolled back.
+	renumbered, err := mergeRepo(target, stale, survivor, true, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renumbered != 2 {
+		t.Errorf("dry run: want 2 builds renumbered, got %d", renumbered)
+	}
+	if got := mergeState(t, target); !reflect.DeepEqual(got, before) {
+		t.Errorf("dry run: want state unchanged\n%s\ngot\n%s", strings.Join(before, "\n"), strings.Join(got, "\n"))
+	}
+
+	renumbered, err = mergeRepo(target, stale, survivor, false, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renumbered != 2 {
+		t.Errorf("want 2 builds renumbered, got %d", renumbered)
+	}
+
+	// the builds of the stale repository are numbered after
+	// the surviving repository counter, and the duplicate
+	// secret of the stale repository is discarded.
+	want := []string{
+		"repo 1 counter 6",
+		"build 1 repo 1 number 1 parent 0",
+		"build 2 repo 1 number 2 parent 0",
+		"build 3 repo 1 number 3 parent 2",
+		"build 4 repo 1 number 5 parent 0",
+		"build 5 repo 1 number 6 parent 5",
+		"stage 1 repo 1 build 1",
+		"stage 2 repo 1 build 4",
+		"stage 3 repo 1 build 5",
+		"secret 1 repo 1 password new",
+		"secret 3 repo 1 token token",
+	}
+	if got := mergeState(t, target); !reflect.DeepEqual(got, want) {
+		t.Errorf("want merged state\n%s\ngot\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+}
+
+// helper function returns the repositories, builds, stages
+// and secrets of the target database.
+func mergeState(t *testing.T, target *sql.DB) []string {
+	t.Helper()
+	var state []string
+
+	repos := []*RepoV1{}
+	if err := meddler.QueryAll(target, &repos, "SELECT * FROM repos ORDER BY repo_id"); err != nil {
+		t.Fatal(err)
+	}
+	for _, repo := range repos {
+		state = append(state, fmt.Sprintf("repo %d counter %d", repo.ID, repo.Counter))
+	}
+
+	builds := []*BuildV1{}
+	if err := meddler.QueryAll(target, &builds, "SELECT * FROM builds ORDER BY build_id"); err != nil {
+		t.Fatal(err)
+	}
+	for _, build := range builds {
+		state = append(state, fmt.Sprintf("build %d repo %d number %d parent %d", build.ID, build.RepoID, build.Number, build.Parent))
+	}
+
+	stages := []*StageV1{}
+	if err := meddler.QueryAll(target, &stages, "SELECT * FROM stages ORDER BY stage_id"); err != nil {
+		t.Fatal(err)
+	}
+	for _, stage := range stages {
+		state = append(state, fmt.Sprintf("stage %d repo %d build %d", stage.ID, stage.RepoID, stage.BuildID))
+	}
+
+	secrets := []*SecretV1{}
+	if err := meddler.QueryAll(target, &secrets, "SELECT * FROM secrets ORDER BY secret_id"); err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range secrets {
+		state = append(state, fmt.Sprintf("secret %d repo %d %s %s", secret.ID, secret.RepoID, secret.Name, secret.Data))
+	}
+	return state
+}
@@ -0,0 +1,180 @@
+package migrate
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// metrics holds the migration metrics exposed by the metrics
+// handler. The step metrics are a snapshot of the step report,
+// taken by the migration step while it runs, so that the
+// handler never reads a report that is being updated.
+var metrics = &registry{
+	steps: map[string]*stepSnapshot{},
+}
+
+type registry struct {
+	// the counters are updated atomically, and are first in
+	// the struct to guarantee 64-bit alignment.
+	scmRequests int64
+	scmErrors   int64
+	s3Uploads   int64
+	s3Bytes     int64
+	throttled   int64
+
+	sync.Mutex
+	steps map[string]*stepSnapshot
+}
+
+// stepSnapshot is a copy of the counters of a step report.
+type stepSnapshot struct {
+	report   StepReport
+	expected int64
+	done     int64
+	eta      float64
+	duration float64
+}
+
+// MetricsHandler returns an http handler that exposes the
+// migration metrics in the prometheus text format.
+func MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		metrics.write(w)
+	})
+}
+
+// InstrumentTransport returns an http transport that counts
+// the requests to the source code management system. If the
+// transport is nil, the default transport is used.
+func InstrumentTransport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &instrumentedTransport{base: base}
+}
+
+type instrumentedTransport struct {
+	base http.RoundTripper
+}
+
+func (t *instrumentedTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	res, err := t.base.RoundTrip(r)
+	atomic.AddInt64(&metrics.scmRequests, 1)
+	if err != nil || res.StatusCode >= 400 {
+		atomic.AddInt64(&metrics.scmErrors, 1)
+	}
+	return res, err
+}
+
+// helper function records the upload of an object to s3.
+func (r *registry) upload(size int) {
+	atomic.AddInt64(&r.s3Uploads, 1)
+	atomic.AddInt64(&r.s3Bytes, int64(size))
+}
+
+// helper function records a snapshot of the step report.
+func (r *registry) observe(s *StepReport) {
+	snapshot := &stepSnapshot{
+		report:   *s,
+		expected: s.expected,
+		done:     s.done,
+		eta:      s.eta().Seconds(),
+		duration: s.Duration,
+	}
+	// the duration is recorded when the step finishes, and
+	// is the elapsed time while the step is running.
+	if snapshot.duration == 0 {
+		snapshot.duration = time.Since(s.started).Seconds()
+	}
+	snapshot.report.Failures = nil
+	snapshot.report.Warnings = nil
+
+	r.Lock()
+	r.steps[s.Step] = snapshot
+	r.Unlock()
+}
+
+// helper function writes the metrics in the prometheus text
+// format.
+func (r *registry) write(w io.Writer) {
+	r.Lock()
+	steps := make([]*stepSnapshot, 0, len(r.steps))
+	for _, snapshot := range r.steps {
+		steps = append(steps, snapshot)
+	}
+	r.Unlock()
+	sort.Slice(steps, func(i, j int) bool {
+		return steps[i].report.Step < steps[j].report.Step
+	})
+
+	header(w, "drone_migrate_rows_total", "counter", "Number of rows processed by migration step, entity and result.")
+	for _, s := range steps {
+		labels := fmt.Sprintf(`step=%q,entity=%q`, s.report.Step, failureEntity(s.report.Step))
+		for _, v := range []struct {
+			result string
+			value  int64
+		}{
+			{"read", s.report.Read},
+			{"inserted", s.report.Inserted},
+			{"updated", s.report.Updated},
+			{"deleted", s.report.Deleted},
+			{"skipped", s.report.Skipped},
+			{"conflict", s.report.Conflicts},
+			{"failed", s.report.Failed},
+		} {
+			fmt.Fprintf(w, "drone_migrate_rows_total{%s,result=%q} %d\n", labels, v.result, v.value)
+		}
+	}
+
+	header(w, "drone_migrate_errors_total", "counter", "Number of records that failed to migrate by migration step.")
+	for _, s := range steps {
+		fmt.Fprintf(w, "drone_migrate_errors_total{step=%q} %d\n", s.report.Step, s.report.Failed)
+	}
+
+	header(w, "drone_migrate_step_rows_expected", "gauge", "Number of rows the migration step is expected to process.")
+	for _, s := range steps {
+		fmt.Fprintf(w, "drone_migrate_step_rows_expected{step=%q} %d\n", s.report.Step, s.expected)
+	}
+
+	header(w, "drone_migrate_step_rows_processed", "gauge", "Number of rows processed by the migration step.")
+	for _, s := range steps {
+		fmt.Fprintf(w, "drone_migrate_step_rows_processed{step=%q} %d\n", s.report.Step, s.done)
+	}
+
+	header(w, "drone_migrate_step_eta_seconds", "gauge", "Estimated time until the migration step completes.")
+	for _, s := range steps {
+		fmt.Fprintf(w, "drone_migrate_step_eta_seconds{step=%q} %g\n", s.report.Step, s.eta)
+	}
+
+	header(w, "drone_migrate_step_duration_seconds", "gauge", "Duration of the migration step.")
+	for _, s := range steps {
+		fmt.Fprintf(w, "drone_migrate_step_duration_seconds{step=%q} %g\n", s.report.Step, s.duration)
+	}
+
+	header(w, "drone_migrate_scm_requests_total", "counter", "Number of requests to the source code management system.")
+	fmt.Fprintf(w, "drone_migrate_scm_requests_total %d\n", atomic.LoadInt64(&r.scmRequests))
+
+	header(w, "drone_migrate_scm_errors_total", "counter", "Number of failed requests to the source code management system.")
+	fmt.Fprintf(w, "drone_migrate_scm_errors_total %d\n", atomic.LoadInt64(&r.scmErrors))
+
+	header(w, "drone_migrate_s3_uploads_total", "counter", "Number of objects uploaded to s3.")
+	fmt.Fprintf(w, "drone_migrate_s3_uploads_total %d\n", atomic.LoadInt64(&r.s3Uploads))
+
+	header(w, "drone_migrate_s3_uploaded_bytes_total", "counter", "Number of bytes uploaded to s3.")
+	fmt.Fprintf(w, "drone_migrate_s3_uploaded_bytes_total %d\n", atomic.LoadInt64(&r.s3Bytes))
+
+	header(w, "drone_migrate_source_throttled_seconds_total", "counter", "Time spent waiting to read the source database.")
+	fmt.Fprintf(w, "drone_migrate_source_throttled_seconds_total %g\n", time.Duration(atomic.LoadInt64(&r.throttled)).Seconds())
+}
+
+// helper function writes the help and type of the metric.
+func header(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+}
@@ -0,0 +1,126 @@
+package migrate
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/russross/meddler"
+	"github.com/sirupsen/logrus"
+)
+
+// OffloadLogs moves the logs from the V1 database to the log
+// sink. Each log is written to the sink and verified before
+// the database row is deleted. If keep is true, the log data
+// is set to null instead of deleting the row.
+func OffloadLogs(target *sql.DB, sink LogSink, keep bool, opts Options) (err error) {
+	defer closeSink(sink, &err)
+
+	task, err := beginTask(target, "offload-logs", opts)
+	if err != nil {
+		return err
+	}
+	defer func() { task.end(err) }()
+
+	logrus.WithField("sink", sink.Name()).Infoln("offloading logs")
+	task.count(target, logsOffloadCountQuery)
+
+	if err := task.begin(); err != nil {
+		return err
+	}
+
+	stmt := logsDeleteStmt
+	if keep {
+		stmt = logsNullStmt
+	}
+
+	// the logs are read one page at a time, and the page is
+	// closed before the rows are deleted, since an open result
+	// set may prevent the transaction from being committed.
+	stats := newThroughput()
+	for last := task.ledger.LastID; ; {
+		logsV1 := []*LogsV1{}
+		err := meddler.QueryAll(target, &logsV1, fmt.Sprintf(logsOffloadQuery, last, opts.pageSize()))
+		if err != nil {
+			return err
+		}
+		if len(logsV1) == 0 {
+			break
+		}
+
+		for _, logV1 := range logsV1 {
+			last = logV1.ID
+			task.report.Read++
+
+			log := logrus.WithField("step", logV1.ID)
+
+			if err := offloadLog(sink, logV1, opts.DryRun); err != nil {
+				log.WithError(err).Errorln("offload failed")
+				return err
+			}
+			stats.add(len(logV1.Data), 1000)
+
+			if err := task.exec(stmt, logV1.ID); err != nil {
+				log.WithError(err).Errorln("offload failed")
+				return err
+			}
+			task.report.Inserted++
+			task.ledger.Rows++
+
+			if err := task.progress(logV1.ID); err != nil {
+				return err
+			}
+		}
+	}
+
+	stats.log()
+	logrus.Infof("offloaded %d logs", task.report.Inserted)
+	return task.commit()
+}
+
+// helper function writes the logs to the sink, unless they
+// have already been written, and verifies the logs exist in
+// the sink.
+func offloadLog(sink LogSink, logV1 *LogsV1, dryRun bool) error {
+	exists, err := sink.Exists(logV1.ID, len(logV1.Data))
+	if err != nil || exists || dryRun {
+		return err
+	}
+	if err := sink.Write(logV1.ID, logV1.Data); err != nil {
+		return err
+	}
+	if err := sink.Flush(); err != nil {
+		return err
+	}
+	exists, err = sink.Exists(logV1.ID, len(logV1.Data))
+	if err == nil && !exists {
+		err = fmt.Errorf("cannot verify logs for step %d", logV1.ID)
+	}
+	return err
+}
+
+const logsOffloadQuery = `
+SELECT *
+FROM logs
+WHERE log_id > %d
+  AND log_data IS NOT NULL
+ORDER BY log_id
+LIMIT %d
+`
+
+const logsOffloadCountQuery = `
+SELECT COUNT(*)
+FROM logs
+WHERE log_id > %d
+  AND log_data IS NOT NULL
+`
+
+const logsDeleteStmt = `
+DELETE FROM logs
+WHERE log_id = ?
+`
+
+const logsNullStmt = `
+UPDATE logs
+SET log_data = NULL
+WHERE log_id = ?
+`
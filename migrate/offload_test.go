@@ -0,0 +1,97 @@
+package migrate
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/russross/meddler"
+)
+
+func TestOffloadLogs(t *testing.T) {
+	target := openTarget(t)
+	dir := t.TempDir()
+	sink := NewFileSink(dir)
+
+	for id := int64(1); id <= 5; id++ {
+		logs := &LogsV1{ID: id, Data: []byte(`[{"out":"hello world"}]`)}
+		if err := meddler.Insert(target, "logs", logs); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the logs of step 4 cannot be written, since a directory
+	// exists at the path of the temporary file.
+	if err := os.MkdirAll(filepath.Join(dir, "000", "000", "4.tmp"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// each row is committed once it is deleted, so that the
+	// rows deleted before the failure are kept deleted.
+	opts := Options{PageSize: 2, BatchSize: 1, Report: new(Report)}
+	if err := OffloadLogs(target, sink, false, opts); err == nil {
+		t.Errorf("want error writing logs")
+	}
+	if got, want := logRows(t, target), []int64{4, 5}; !reflect.DeepEqual(got, want) {
+		t.Errorf("want rows %v kept after failed write, got %v", want, got)
+	}
+	for _, id := range []int64{1, 2, 3} {
+		data, err := ioutil.ReadFile(filepath.Join(dir, "000", "000", fmt.Sprint(id)))
+		if err != nil || string(data) != `[{"out":"hello world"}]` {
+			t.Errorf("step %d: want logs written to sink, got %q, %v", id, data, err)
+		}
+	}
+
+	// the row is kept if the logs cannot be verified after
+	// they are written.
+	if err := os.Remove(filepath.Join(dir, "000", "000", "4.tmp")); err != nil {
+		t.Fatal(err)
+	}
+	if err := OffloadLogs(target, &unverifiedSink{sink}, false, opts); err == nil {
+		t.Errorf("want error verifying logs")
+	}
+	if got, want := logRows(t, target), []int64{4, 5}; !reflect.DeepEqual(got, want) {
+		t.Errorf("want rows %v kept after failed verification, got %v", want, got)
+	}
+
+	// the offload resumes after the last deleted row.
+	if err := OffloadLogs(target, sink, false, opts); err != nil {
+		t.Fatal(err)
+	}
+	if got := logRows(t, target); len(got) != 0 {
+		t.Errorf("want all rows deleted, got %v", got)
+	}
+}
+
+// unverifiedSink is a log sink that never finds the written
+// logs.
+type unverifiedSink struct {
+	LogSink
+}
+
+func (s *unverifiedSink) Exists(step int64, size int) (bool, error) {
+	return false, nil
+}
+
+// helper function returns the identifiers of the log rows.
+func logRows(t *testing.T, target *sql.DB) []int64 {
+	t.Helper()
+	rows, err := target.Query("SELECT log_id FROM logs ORDER BY log_id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
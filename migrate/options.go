@@ -0,0 +1,159 @@
+package migrate
+
+import "time"
+
+// DefaultPageSize is the number of source rows read per page
+// when no page size is configured.
+const DefaultPageSize = 1000
+
+// DefaultLogWorkers is the number of concurrent log workers
+// when no number is configured.
+const DefaultLogWorkers = 4
+
+// DefaultBatchSize is the number of rows inserted per
+// transaction when no batch size is configured.
+const DefaultBatchSize = 1000
+
+// DefaultProgressInterval is the interval at which the
+// progress of a migration step is logged when no interval is
+// configured.
+const DefaultProgressInterval = 10 * time.Second
+
+// Options configures the execution of a migration step.
+type Options struct {
+	// DryRun performs all reads and conversions, and inserts
+	// the converted rows inside a transaction that is always
+	// rolled back. Insert failures are reported as conflicts
+	// instead of aborting the migration step.
+	DryRun bool
+
+	// Report collects a summary of the rows processed by each
+	// migration step. This value is optional.
+	Report *Report
+
+	// PageSize is the number of source rows read per query.
+	// Rows are read in pages ordered by primary key so that
+	// memory use does not grow with the size of the table.
+	PageSize int
+
+	// BatchSize is the number of rows inserted per transaction.
+	// The ledger is updated with the last committed source id
+	// in the same transaction, so that a failed step resumes
+	// after the last committed batch. If zero, each migration
+	// step runs in a single transaction.
+	BatchSize int
+
+	// StepBatchSize overrides the batch size of the named
+	// migration steps.
+	StepBatchSize map[string]int
+
+	// LogWorkers is the number of workers that concurrently
+	// fetch and upload logs.
+	LogWorkers int
+
+	// OnConflict defines how rows that conflict with existing
+	// rows in the V1 database are inserted, so that a step can
+	// be re-run after a partial migration. If empty, a conflict
+	// fails the migration step.
+	OnConflict ConflictPolicy
+
+	// OnError defines how a record that fails to migrate is
+	// handled. Failed records are recorded in the failure
+	// ledger of the V1 database. If empty, migration steps
+	// abort at the first failed record, and the steps that
+	// update repositories in the remote system skip it.
+	OnError ErrorPolicy
+
+	// Retry limits the migration step to the records with
+	// these identifiers, which are typically read from the
+	// failure ledger. The recorded progress of the step is
+	// neither used nor updated. This value is optional.
+	Retry []int64
+
+	// Sync migrates the rows that changed since the previous
+	// run, in addition to the new rows, so that the migration
+	// can be repeated while the V0 server is running. Users and
+	// repositories are refreshed, secrets and registries are
+	// migrated again, encrypted if the V1 secrets are
+	// encrypted, and builds, stages, steps and logs that
+	// were running or completed after the recorded watermark
+	// are migrated again. Rows are inserted with the update
+	// conflict policy, which should also be the policy of the
+	// database log sink.
+	Sync bool
+
+	// EncryptionKey is the key with which secrets are encrypted
+	// once the secrets of the V1 database are encrypted, so
+	// that synced secrets are encrypted. This value is
+	// optional.
+	EncryptionKey string
+
+	// StageLabels lists the variables of the 0.8 stage
+	// environment, which holds the matrix axes of the stage,
+	// that are migrated to stage labels. If empty, all
+	// variables are migrated.
+	StageLabels []string
+
+	// Throttle limits the rate at which the V0 database is
+	// read. It is applied when the source database is opened
+	// with OpenSource or OpenSnapshot. This value is optional.
+	Throttle Throttle
+
+	// ProgressInterval is the interval at which the progress
+	// of a migration step is logged. If zero, the default
+	// interval is used. If negative, progress is not logged.
+	ProgressInterval time.Duration
+
+	// ResumeLogs overrides the recorded progress of the log
+	// migration, resuming after the given step identifier.
+	// This value is optional.
+	ResumeLogs int64
+}
+
+// helper function adds the named migration step to the
+// report, and configures the interval at which its progress
+// is logged.
+func (o Options) step(name string) *StepReport {
+	s := o.Report.add(name)
+	s.interval = o.ProgressInterval
+	if s.interval == 0 {
+		s.interval = DefaultProgressInterval
+	}
+	return s
+}
+
+// helper function returns the conflict policy. Synced rows
+// replace the existing rows.
+func (o Options) conflictPolicy() ConflictPolicy {
+	if o.Sync {
+		return ConflictUpdate
+	}
+	return o.OnConflict
+}
+
+// helper function returns the page size, or the default page
+// size if not configured.
+func (o Options) pageSize() int {
+	if o.PageSize <= 0 {
+		return DefaultPageSize
+	}
+	return o.PageSize
+}
+
+// helper function returns the batch size of the named
+// migration step.
+func (o Options) batchSize(step string) int {
+	if size, ok := o.StepBatchSize[step]; ok {
+		return size
+	}
+	return o.BatchSize
+}
+
+// helper function returns the number of log workers, or the
+// default number of log workers if not configured.
+func (o Options) logWorkers() int {
+	if o.LogWorkers <= 0 {
+		return DefaultLogWorkers
+	}
+	return o.LogWorkers
+}
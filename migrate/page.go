@@ -0,0 +1,74 @@
+package migrate
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/russross/meddler"
+	"github.com/sirupsen/logrus"
+)
+
+// helper function iterates over the rows of a keyset paginated
+// query one page at a time, so that memory use does not grow
+// with the size of the source table. The query is formatted
+// with the identifier of the last row read and the page size.
+// The scan function processes the current row and returns its
+// identifier, which must be the key by which rows are ordered.
+// The scan function must not advance the rows.
+func paginate(source *sql.DB, query string, after int64, size int, scan func(rows *sql.Rows) (int64, error)) error {
+	for {
+		rows, err := source.Query(fmt.Sprintf(query, after, size))
+		if err != nil {
+			return err
+		}
+
+		var count int
+		for rows.Next() {
+			id, err := scan(rows)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			after = id
+			count++
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return err
+		}
+		if count < size {
+			return nil
+		}
+	}
+}
+
+// helper function counts the rows of the query formatted with
+// the identifier of the last row read. The count is used to
+// estimate the progress of a step, so an error is logged and
+// zero returned instead of failing the step.
+func countRows(db *sql.DB, query string, after int64) int64 {
+	var count int64
+	if err := db.QueryRow(fmt.Sprintf(query, after)).Scan(&count); err != nil {
+		logrus.WithError(err).Warnln("cannot count rows, progress not estimated")
+		return 0
+	}
+	return count
+}
+
+// helper function scans the current row into the struct. Unlike
+// meddler.Scan, it does not advance the rows.
+func scanRow(rows *sql.Rows, dst interface{}) error {
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	targets, err := meddler.Default.Targets(dst, columns)
+	if err != nil {
+		return err
+	}
+	if err := rows.Scan(targets...); err != nil {
+		return err
+	}
+	return meddler.Default.WriteTargets(dst, columns, targets)
+}
@@ -0,0 +1,186 @@
+package migrate
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/russross/meddler"
+	"github.com/sirupsen/logrus"
+)
+
+// errPoolStopped is returned to the producer when the pool
+// stops accepting jobs because a job failed to complete.
+var errPoolStopped = errors.New("worker pool stopped")
+
+// logJob is a unit of work processed by the log worker pool.
+type logJob struct {
+	seq    int64
+	step   *StepV0
+	logs   *LogsV0
+	exists bool
+	err    error
+
+	// data is the logs converted to the 1.x format, and lines
+	// is the number of lines converted. convErr is not nil if
+	// the 0.x logs are malformed.
+	data    []byte
+	lines   int
+	convErr error
+}
+
+// helper function fetches the V0 logs of the job step. The
+// logs are nil if the step has no logs. Any other error is
+// recorded, so that the step fails and can be retried.
+func (j *logJob) fetch(source *sql.DB) {
+	logs := &LogsV0{}
+	err := meddler.QueryRow(source, logs, fmt.Sprintf(logsFindQuery, j.step.ID))
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		j.err = err
+	default:
+		j.logs = logs
+	}
+}
+
+// helper function processes the steps submitted by produce
+// with a bounded pool of workers. Jobs are processed by work
+// concurrently, and completed by complete in the order they
+// were submitted, so that the last completed step is always
+// a safe point from which to resume. Processing stops at the
+// first error returned by complete.
+func runLogWorkers(
+	workers int,
+	produce func(submit func(*StepV0) error) error,
+	work func(*logJob),
+	complete func(*logJob) error,
+) error {
+	if workers < 1 {
+		workers = 1
+	}
+
+	var (
+		jobs    = make(chan *logJob)
+		results = make(chan *logJob)
+		quit    = make(chan struct{})
+		errc    = make(chan error, 1)
+
+		// window limits the number of jobs that are processed
+		// but not yet completed, so that a slow job does not
+		// cause the completed jobs to accumulate in memory.
+		window = make(chan struct{}, workers*4)
+	)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				work(job)
+				results <- job
+			}
+		}()
+	}
+
+	go func() {
+		var seq int64
+		errc <- produce(func(step *StepV0) error {
+			select {
+			case window <- struct{}{}:
+			case <-quit:
+				return errPoolStopped
+			}
+			select {
+			case jobs <- &logJob{seq: seq, step: step}:
+				seq++
+				return nil
+			case <-quit:
+				return errPoolStopped
+			}
+		})
+		close(jobs)
+	}()
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	var (
+		err     error
+		next    int64
+		pending = map[int64]*logJob{}
+	)
+	for job := range results {
+		if err != nil {
+			continue
+		}
+		pending[job.seq] = job
+		for err == nil {
+			job, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			next++
+			<-window
+			if err = complete(job); err != nil {
+				close(quit)
+			}
+		}
+	}
+
+	if perr := <-errc; err == nil && perr != errPoolStopped {
+		err = perr
+	}
+	return err
+}
+
+// throughput tracks the number of logs and bytes processed
+// by a migration step.
+type throughput struct {
+	start time.Time
+	count int64
+	bytes int64
+}
+
+// helper function returns a new throughput tracker.
+func newThroughput() *throughput {
+	return &throughput{start: time.Now()}
+}
+
+// helper function records a processed row of the given size,
+// and logs the throughput every interval rows.
+func (t *throughput) add(size int, interval int64) {
+	t.count++
+	t.bytes += int64(size)
+	if t.count%interval == 0 {
+		t.log()
+	}
+}
+
+// helper function logs the throughput.
+func (t *throughput) log() {
+	elapsed := time.Since(t.start).Seconds()
+	if elapsed == 0 {
+		return
+	}
+	logrus.
+		WithField("logs", t.count).
+		WithField("bytes", t.bytes).
+		Infof("processed %d logs, %.1f logs/s, %.1f KB/s",
+			t.count,
+			float64(t.count)/elapsed,
+			float64(t.bytes)/elapsed/1024,
+		)
+}
+
+const logsFindQuery = `
+SELECT *
+FROM logs
+WHERE log_job_id = %d
+`
@@ -0,0 +1,100 @@
+package migrate
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRunLogWorkers(t *testing.T) {
+	for _, workers := range []int{0, 1, 4} {
+		var got []int64
+		err := runLogWorkers(workers,
+			func(submit func(*StepV0) error) error {
+				for i := int64(1); i <= 20; i++ {
+					if err := submit(&StepV0{ID: i}); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+			func(job *logJob) {
+				// later steps finish first, so that the jobs
+				// complete out of order.
+				time.Sleep(time.Duration(20-job.step.ID) * time.Millisecond)
+			},
+			func(job *logJob) error {
+				got = append(got, job.step.ID)
+				return nil
+			},
+		)
+		if err != nil {
+			t.Errorf("%d workers: %s", workers, err)
+		}
+		var want []int64
+		for i := int64(1); i <= 20; i++ {
+			want = append(want, i)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%d workers: want steps completed in order %v, got %v", workers, want, got)
+		}
+	}
+}
+
+func TestRunLogWorkersError(t *testing.T) {
+	errComplete := errors.New("cannot complete step")
+
+	var got []int64
+	err := runLogWorkers(4,
+		func(submit func(*StepV0) error) error {
+			for i := int64(1); i <= 1000; i++ {
+				if err := submit(&StepV0{ID: i}); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		func(job *logJob) {},
+		func(job *logJob) error {
+			got = append(got, job.step.ID)
+			if job.step.ID == 5 {
+				return errComplete
+			}
+			return nil
+		},
+	)
+	if err != errComplete {
+		t.Errorf("want error %q, got %v", errComplete, err)
+	}
+	if want := []int64{1, 2, 3, 4, 5}; !reflect.DeepEqual(got, want) {
+		t.Errorf("want steps %v completed before the error, got %v", want, got)
+	}
+}
+
+func TestRunLogWorkersProduceError(t *testing.T) {
+	errProduce := errors.New("cannot query steps")
+
+	var got []int64
+	err := runLogWorkers(2,
+		func(submit func(*StepV0) error) error {
+			for i := int64(1); i <= 3; i++ {
+				if err := submit(&StepV0{ID: i}); err != nil {
+					return err
+				}
+			}
+			return errProduce
+		},
+		func(job *logJob) {},
+		func(job *logJob) error {
+			got = append(got, job.step.ID)
+			return nil
+		},
+	)
+	if err != errProduce {
+		t.Errorf("want error %q, got %v", errProduce, err)
+	}
+	if want := []int64{1, 2, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("want submitted steps %v completed, got %v", want, got)
+	}
+}
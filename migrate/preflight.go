@@ -0,0 +1,330 @@
+package migrate
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/russross/meddler"
+	"github.com/sirupsen/logrus"
+)
+
+// Issue describes a row in the V0 database that will be
+// rejected by the V1 database schema, or a row in the V1
+// database that violates referential integrity.
+type Issue struct {
+	Check    string `json:"check"`
+	Table    string `json:"table"`
+	ID       int64  `json:"id"`
+	Column   string `json:"column,omitempty"`
+	Value    string `json:"value,omitempty"`
+	Message  string `json:"message"`
+	Fix      string `json:"fix"`
+	Repaired bool   `json:"repaired,omitempty"`
+
+	// Warning is true if the row is not rejected, but the
+	// migration changes the value, for example by truncating
+	// a value that exceeds the column length.
+	Warning bool `json:"warning,omitempty"`
+}
+
+// preflightCheck defines a query that returns the identifier
+// and offending value of each row that fails the check.
+type preflightCheck struct {
+	name    string
+	table   string
+	column  string
+	query   string
+	message string
+	fix     string
+}
+
+// columnLimit defines the maximum length of a V1 column, and
+// the V0 column from which it is migrated. The limit is the
+// smallest limit across the supported database dialects.
+type columnLimit struct {
+	table  string
+	id     string
+	column string
+	target string
+	limit  int
+}
+
+// columnLimits lists the V0 columns that are copied to length
+// limited V1 columns. See the ddl in the migrate/db package.
+// The stage name is computed from the proc name and labels,
+// and is checked separately, see preflightStageNames.
+var columnLimits = []columnLimit{
+	{"users", "user_id", "user_login", "users.user_login", 250},
+	{"users", "user_id", "user_email", "users.user_email", 500},
+	{"users", "user_id", "user_avatar", "users.user_avatar", 2000},
+	{"users", "user_id", "user_token", "users.user_oauth_token", 500},
+	{"users", "user_id", "user_secret", "users.user_oauth_refresh", 500},
+	{"repos", "repo_id", "repo_owner", "repos.repo_namespace", 250},
+	{"repos", "repo_id", "repo_name", "repos.repo_name", 250},
+	{"repos", "repo_id", "repo_full_name", "repos.repo_slug", 250},
+	{"repos", "repo_id", "repo_clone", "repos.repo_clone_url", 2000},
+	{"repos", "repo_id", "repo_link", "repos.repo_html_url", 2000},
+	{"repos", "repo_id", "repo_branch", "repos.repo_branch", 250},
+	{"repos", "repo_id", "repo_visibility", "repos.repo_visibility", 50},
+	{"repos", "repo_id", "repo_config_path", "repos.repo_config", 500},
+	{"builds", "build_id", "build_event", "builds.build_event", 50},
+	{"builds", "build_id", "build_status", "builds.build_status", 50},
+	{"builds", "build_id", "build_error", "builds.build_error", 500},
+	{"builds", "build_id", "build_link", "builds.build_link", 1000},
+	{"builds", "build_id", "build_commit", "builds.build_after", 50},
+	{"builds", "build_id", "build_ref", "builds.build_ref", 500},
+	{"builds", "build_id", "build_branch", "builds.build_target", 500},
+	{"builds", "build_id", "build_author", "builds.build_author", 500},
+	{"builds", "build_id", "build_email", "builds.build_author_email", 500},
+	{"builds", "build_id", "build_avatar", "builds.build_author_avatar", 1000},
+	{"builds", "build_id", "build_sender", "builds.build_sender", 500},
+	{"builds", "build_id", "build_deploy", "builds.build_deploy", 500},
+	{"procs", "proc_id", "proc_state", "stages.stage_status", 50},
+	{"procs", "proc_id", "proc_error", "stages.stage_error", 500},
+	{"procs", "proc_id", "proc_machine", "stages.stage_machine", 500},
+	{"secrets", "secret_id", "secret_name", "secrets.secret_name", 500},
+}
+
+// Preflight scans the V0 database for rows that will be
+// rejected by the V1 database schema, such as duplicate
+// repository names or values that exceed the column length.
+// The driver is the name of the V0 database driver. Stage
+// names that will be truncated by the migration are reported
+// as warnings.
+func Preflight(source *sql.DB, driver string, opts Options) ([]*Issue, error) {
+	checks := []preflightCheck{
+		{
+			name:    "duplicate-repo",
+			table:   "repos",
+			column:  "repo_full_name",
+			query:   preflightRepoQuery,
+			message: "duplicate repository name (case-insensitive), violates the unique repo_slug constraint",
+			fix:     "delete or merge the stale repository, which usually results from a rename",
+		},
+		{
+			name:    "duplicate-user",
+			table:   "users",
+			column:  "user_login",
+			query:   preflightUserQuery,
+			message: "duplicate user login (case-insensitive), violates the unique user_login constraint",
+			fix:     "delete or rename the duplicate user account",
+		},
+		{
+			name:    "duplicate-secret",
+			table:   "secrets",
+			column:  "secret_name",
+			query:   preflightSecretQuery,
+			message: "duplicate secret name for repository, violates the unique (secret_repo_id, secret_name) constraint",
+			fix:     "delete the duplicate secret",
+		},
+		{
+			name:    "duplicate-build",
+			table:   "builds",
+			column:  "build_number",
+			query:   preflightBuildQuery,
+			message: "duplicate build number for repository, violates the unique (build_repo_id, build_number) constraint",
+			fix:     "delete or renumber the duplicate build",
+		},
+		{
+			name:    "missing-parent",
+			table:   "procs",
+			column:  "proc_ppid",
+			query:   preflightParentQuery,
+			message: "parent proc does not exist, the step cannot be linked to a stage",
+			fix:     "delete the orphaned proc",
+		},
+	}
+
+	length := "LENGTH"
+	if driver == "mysql" {
+		length = "CHAR_LENGTH"
+	}
+	for _, c := range columnLimits {
+		checks = append(checks, preflightCheck{
+			name:    "value-too-long",
+			table:   c.table,
+			column:  c.column,
+			query:   fmt.Sprintf(preflightLengthQuery, c.id, c.column, c.table, length, c.column, c.limit, c.id),
+			message: fmt.Sprintf("value exceeds the %d character limit of %s", c.limit, c.target),
+			fix:     fmt.Sprintf("shorten the value to %d characters or less", c.limit),
+		})
+	}
+
+	issues := []*Issue{}
+	for _, check := range checks {
+		log := logrus.
+			WithField("check", check.name).
+			WithField("table", check.table).
+			WithField("column", check.column)
+		log.Debugln("run preflight check")
+
+		found, err := runPreflightCheck(source, check)
+		if err != nil {
+			log.WithError(err).Errorln("preflight check failed")
+			return nil, err
+		}
+		if len(found) != 0 {
+			log.Warnf("preflight check found %d issues", len(found))
+		}
+		issues = append(issues, found...)
+	}
+
+	found, err := preflightStageNames(source, opts)
+	if err != nil {
+		logrus.WithError(err).Errorln("preflight check failed")
+		return nil, err
+	}
+	if len(found) != 0 {
+		logrus.WithField("check", "stage-name-truncated").
+			Warnf("preflight check found %d issues", len(found))
+	}
+	return append(issues, found...), nil
+}
+
+// helper function returns a warning for each stage whose name,
+// including the stage labels, exceeds the length of the stage
+// name column, and is therefore truncated by the migration.
+func preflightStageNames(source *sql.DB, opts Options) ([]*Issue, error) {
+	var issues []*Issue
+	scan := func(rows *sql.Rows) (int64, error) {
+		stageV0 := &StageV0{}
+		if err := scanRow(rows, stageV0); err != nil {
+			return 0, err
+		}
+		name := stageName(stageV0.Name, stageLabels(stageV0.Environ, opts.StageLabels))
+		if truncateChars(name, 100) != name {
+			issues = append(issues, &Issue{
+				Check:   "stage-name-truncated",
+				Table:   "procs",
+				ID:      stageV0.ID,
+				Column:  "proc_name",
+				Value:   name,
+				Message: "stage name, including the stage labels, exceeds the 100 character limit of stages.stage_name, and will be truncated",
+				Fix:     "shorten the stage name, or restrict the stage labels with --stage-labels",
+				Warning: true,
+			})
+		}
+		return stageV0.ID, nil
+	}
+	if err := paginate(source, preflightStageQuery, 0, opts.pageSize(), scan); err != nil {
+		return nil, err
+	}
+	return issues, nil
+}
+
+// helper function executes the check and returns an issue for
+// each row returned by the check query.
+func runPreflightCheck(source meddler.DB, check preflightCheck) ([]*Issue, error) {
+	rows, err := source.Query(check.query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var issues []*Issue
+	for rows.Next() {
+		var (
+			id    int64
+			value sql.NullString
+		)
+		if err := rows.Scan(&id, &value); err != nil {
+			return nil, err
+		}
+		issues = append(issues, &Issue{
+			Check:   check.name,
+			Table:   check.table,
+			ID:      id,
+			Column:  check.column,
+			Value:   value.String,
+			Message: check.message,
+			Fix:     check.fix,
+		})
+	}
+	return issues, rows.Err()
+}
+
+const preflightRepoQuery = `
+SELECT repo_id, repo_full_name
+FROM repos
+WHERE repo_user_id > 0
+  AND LOWER(repo_full_name) IN (
+    SELECT LOWER(repo_full_name)
+    FROM repos
+    WHERE repo_user_id > 0
+    GROUP BY LOWER(repo_full_name)
+    HAVING COUNT(*) > 1
+  )
+ORDER BY LOWER(repo_full_name), repo_id
+`
+
+const preflightUserQuery = `
+SELECT user_id, user_login
+FROM users
+WHERE LOWER(user_login) IN (
+    SELECT LOWER(user_login)
+    FROM users
+    GROUP BY LOWER(user_login)
+    HAVING COUNT(*) > 1
+  )
+ORDER BY LOWER(user_login), user_id
+`
+
+const preflightSecretQuery = `
+SELECT s1.secret_id, s1.secret_name
+FROM secrets s1
+INNER JOIN repos ON s1.secret_repo_id = repos.repo_id
+WHERE repos.repo_user_id > 0
+  AND EXISTS (
+    SELECT 1
+    FROM secrets s2
+    WHERE s2.secret_repo_id = s1.secret_repo_id
+      AND s2.secret_name = s1.secret_name
+      AND s2.secret_id != s1.secret_id
+  )
+ORDER BY s1.secret_repo_id, s1.secret_name, s1.secret_id
+`
+
+const preflightBuildQuery = `
+SELECT b1.build_id, b1.build_number
+FROM builds b1
+WHERE EXISTS (
+    SELECT 1
+    FROM builds b2
+    WHERE b2.build_repo_id = b1.build_repo_id
+      AND b2.build_number = b1.build_number
+      AND b2.build_id != b1.build_id
+  )
+ORDER BY b1.build_repo_id, b1.build_number, b1.build_id
+`
+
+const preflightParentQuery = `
+SELECT procs.proc_id, procs.proc_ppid
+FROM procs
+INNER JOIN builds ON procs.proc_build_id = builds.build_id
+INNER JOIN repos ON builds.build_repo_id = repos.repo_id
+WHERE procs.proc_ppid != 0
+  AND repos.repo_user_id > 0
+  AND NOT EXISTS (
+    SELECT 1
+    FROM procs parent
+    WHERE parent.proc_build_id = procs.proc_build_id
+      AND parent.proc_pid = procs.proc_ppid
+  )
+ORDER BY procs.proc_id
+`
+
+const preflightLengthQuery = `
+SELECT %s, %s
+FROM %s
+WHERE %s(%s) > %d
+ORDER BY %s
+`
+
+const preflightStageQuery = `
+SELECT *
+FROM procs
+WHERE proc_ppid = 0
+  AND proc_id > %d
+ORDER BY proc_id
+LIMIT %d
+`
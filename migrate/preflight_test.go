@@ -0,0 +1,52 @@
+package migrate
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPreflightStageNames(t *testing.T) {
+	source := openSource(t)
+
+	long := strings.Repeat("x", 95)
+	execAll(t, source,
+		`INSERT INTO procs (proc_id, proc_build_id, proc_pid, proc_ppid, proc_name, proc_environ)
+		 VALUES (1, 1, 1, 0, 'test', '{"GO_VERSION":"1.11"}')`,
+		`INSERT INTO procs (proc_id, proc_build_id, proc_pid, proc_ppid, proc_name, proc_environ)
+		 VALUES (2, 1, 2, 0, 'test', '{"GO_VERSION":"1.11","PATTERN":"`+long+`"}')`,
+		`INSERT INTO procs (proc_id, proc_build_id, proc_pid, proc_ppid, proc_name)
+		 VALUES (3, 1, 3, 0, '`+strings.Repeat("x", 101)+`')`,
+		`INSERT INTO procs (proc_id, proc_build_id, proc_pid, proc_ppid, proc_name)
+		 VALUES (4, 1, 4, 1, '`+strings.Repeat("x", 101)+`')`,
+	)
+
+	tests := []struct {
+		labels []string
+		want   []int64
+	}{
+		// the labels push the name of stage 2 over the limit.
+		{nil, []int64{2, 3}},
+		{[]string{"GO_VERSION"}, []int64{3}},
+	}
+	for _, test := range tests {
+		issues, err := Preflight(source, "sqlite3", Options{StageLabels: test.labels})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []int64
+		for _, issue := range issues {
+			if issue.Table != "procs" {
+				continue
+			}
+			if issue.Check != "stage-name-truncated" || !issue.Warning {
+				t.Errorf("labels %v: want stage name warning, got %s issue for proc %d", test.labels, issue.Check, issue.ID)
+				continue
+			}
+			got = append(got, issue.ID)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("labels %v: want truncated stages %v, got %v", test.labels, test.want, got)
+		}
+	}
+}
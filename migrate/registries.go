@@ -11,7 +11,31 @@ import (
 
 // MigrateRegistries migrates the registry crendeitals
 // from the V0 database to the V1 database.
-func MigrateRegistries(source, target *sql.DB) error {
+func MigrateRegistries(source, target *sql.DB, opts Options) (err error) {
+	task, err := beginTask(target, "migrate-registries", opts)
+	if err != nil {
+		return err
+	}
+	defer func() { task.end(err) }()
+
+	// registries are merged into a single secret per
+	// repository, and cannot be committed in batches.
+	task.batch = 0
+
+	// the docker config of a repository is merged from all of
+	// its registries, so all registries are read, and the
+	// docker config is rebuilt for the repositories with a
+	// registry created after the last migrated registry.
+	// Registry failures are recorded per repository, and the
+	// registries of retried repositories are rebuilt. When the
+	// step is synced, the docker configs of all repositories
+	// are rebuilt.
+	after := task.ledger.LastID
+	if task.failures.retrying() || task.synced > 0 {
+		after = 0
+		task.synced = 0
+	}
+
 	registriesV0 := []*RegistryV0{}
 	dockerConfigs := make(map[string]DockerConfig, 0)
 
@@ -19,16 +43,33 @@ func MigrateRegistries(source, target *sql.DB) error {
 		return err
 	}
 
-	logrus.Infof("migrating %d registries", len(registriesV0))
-	tx, err := target.Begin()
+	changed := map[int64]bool{}
+	for _, registryV0 := range registriesV0 {
+		if registryV0.ID > after && task.selected(registryV0.RepoID) {
+			changed[registryV0.RepoID] = true
+		}
+	}
 
+	block, err := secretCipher(target, opts)
 	if err != nil {
 		return err
 	}
 
-	defer tx.Rollback()
+	logrus.Infof("migrating %d registries", len(registriesV0))
+	task.expect(int64(len(registriesV0)))
+	if err := task.begin(); err != nil {
+		return err
+	}
 
 	for _, registryV0 := range registriesV0 {
+		if err := task.progress(registryV0.ID); err != nil {
+			return err
+		}
+		if !changed[registryV0.RepoID] {
+			continue
+		}
+		task.report.Read++
+
 		log := logrus.WithFields(logrus.Fields{
 			"repo": registryV0.RepoFullname,
 			"addr": registryV0.Addr,
@@ -68,19 +109,23 @@ func MigrateRegistries(source, target *sql.DB) error {
 		repoV1 := &RepoV1{}
 
 		if err := meddler.QueryRow(target, repoV1, fmt.Sprintf(repoSlugQuery, repoFullname)); err != nil {
-			log.WithError(err).Errorln("failed to get registry repo")
+			task.skip(log.WithError(err), "failed to get registry repo")
 			continue
 		}
 
+		data, err := sealSecret(block, string(result))
+		if err != nil {
+			return err
+		}
+
 		registryV1 := &RegistryV1{
 			RepoID:      repoV1.ID,
 			Name:        ".dockerconfigjson",
-			Data:        string(result),
+			Data:        data,
 			PullRequest: true,
 		}
 
-		if err := meddler.Insert(tx, "secrets", registryV1); err != nil {
-			log.WithError(err).Errorln("migration failed")
+		if err := task.insert("secrets", repoV1.ID, registryV1, log); err != nil {
 			return err
 		}
 
@@ -88,7 +133,7 @@ func MigrateRegistries(source, target *sql.DB) error {
 	}
 
 	logrus.Infof("migration complete")
-	return tx.Commit()
+	return task.commit()
 }
 
 const registryImportQuery = `
@@ -97,4 +142,5 @@ SELECT
 	registry.*
 FROM registry INNER JOIN repos ON (repo_id = registry_repo_id)
 WHERE repo_user_id > 0
+ORDER BY registry_id
 `
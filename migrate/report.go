@@ -0,0 +1,238 @@
+package migrate
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Report summarizes the rows processed by the migration steps.
+type Report struct {
+	Steps []*StepReport `json:"steps"`
+}
+
+// StepReport summarizes the rows processed by a migration step.
+type StepReport struct {
+	Step      string           `json:"step"`
+	Read      int64            `json:"read"`
+	Inserted  int64            `json:"inserted"`
+	Updated   int64            `json:"updated,omitempty"`
+	Deleted   int64            `json:"deleted,omitempty"`
+	Skipped   int64            `json:"skipped"`
+	Conflicts int64            `json:"conflicts"`
+	Failed    int64            `json:"failed"`
+	Lines     int64            `json:"lines,omitempty"`
+	Failures  map[string]int64 `json:"failures,omitempty"`
+	Warnings  map[string]int64 `json:"warnings,omitempty"`
+
+	// Duration is the duration of the step in seconds.
+	Duration float64 `json:"duration"`
+
+	started time.Time
+
+	// expected is the number of rows the step is expected to
+	// process, and done the number of rows processed so far.
+	// The progress is logged, and the metrics updated, every
+	// interval.
+	expected int64
+	done     int64
+	interval time.Duration
+	logged   time.Time
+	observed time.Time
+}
+
+// Failed returns the number of rows that failed in all steps.
+func (r *Report) Failed() int64 {
+	var failed int64
+	for _, step := range r.Steps {
+		failed += step.Failed
+	}
+	return failed
+}
+
+// WriteSummary writes a per-step summary of the report to w.
+func (r *Report) WriteSummary(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "STEP\tREAD\tINSERTED\tSKIPPED\tCONFLICTS")
+	for _, step := range r.Steps {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\n",
+			step.Step,
+			step.Read,
+			step.Inserted,
+			step.Skipped,
+			step.Conflicts,
+		)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	for _, step := range r.Steps {
+		if len(step.Warnings) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "\n%s warnings:\n", step.Step)
+		for _, warning := range sortedKeys(step.Warnings) {
+			fmt.Fprintf(w, "  %s: %d\n", warning, step.Warnings[warning])
+		}
+	}
+	return nil
+}
+
+// WriteJSON writes the report to w in json format.
+func (r *Report) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// WriteMarkdown writes the report to w in markdown format,
+// with a table of all steps followed by the failures and
+// warnings of each step.
+func (r *Report) WriteMarkdown(w io.Writer) error {
+	var b strings.Builder
+	b.WriteString("# Migration Report\n\n")
+	b.WriteString("| Step | Read | Inserted | Updated | Deleted | Skipped | Conflicts | Failed | Duration |\n")
+	b.WriteString("|------|-----:|---------:|--------:|--------:|--------:|----------:|-------:|---------:|\n")
+	for _, step := range r.Steps {
+		fmt.Fprintf(&b, "| %s | %d | %d | %d | %d | %d | %d | %d | %.1fs |\n",
+			step.Step,
+			step.Read,
+			step.Inserted,
+			step.Updated,
+			step.Deleted,
+			step.Skipped,
+			step.Conflicts,
+			step.Failed,
+			step.Duration,
+		)
+	}
+
+	for _, step := range r.Steps {
+		if len(step.Failures) == 0 && len(step.Warnings) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "\n## %s\n", step.Step)
+		if len(step.Failures) != 0 {
+			b.WriteString("\nFailures:\n\n")
+			for _, reason := range sortedKeys(step.Failures) {
+				fmt.Fprintf(&b, "- %s: %d\n", reason, step.Failures[reason])
+			}
+		}
+		if len(step.Warnings) != 0 {
+			b.WriteString("\nWarnings:\n\n")
+			for _, warning := range sortedKeys(step.Warnings) {
+				fmt.Fprintf(&b, "- %s: %d\n", warning, step.Warnings[warning])
+			}
+		}
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// helper function adds a new step to the report. If the
+// report is nil the step is tracked but never reported.
+func (r *Report) add(step string) *StepReport {
+	s := &StepReport{
+		Step:     step,
+		Failures: map[string]int64{},
+		Warnings: map[string]int64{},
+		started:  time.Now(),
+	}
+	s.logged = s.started
+	if r != nil {
+		r.Steps = append(r.Steps, s)
+	}
+	return s
+}
+
+// helper function records a row that failed for the given
+// reason.
+func (s *StepReport) fail(reason string) {
+	s.Failed++
+	s.Failures[reason]++
+}
+
+// helper function records the duration of the step.
+func (s *StepReport) finish() {
+	s.Duration = time.Since(s.started).Seconds()
+	metrics.observe(s)
+}
+
+// helper function records the number of rows the step is
+// expected to process, used to estimate the remaining time.
+func (s *StepReport) expect(rows int64) {
+	s.expected = rows
+	metrics.observe(s)
+}
+
+// helper function records a processed row. The progress is
+// logged every interval, and the metrics updated every
+// second.
+func (s *StepReport) advance() {
+	s.done++
+	now := time.Now()
+	if now.Sub(s.observed) >= time.Second {
+		s.observed = now
+		metrics.observe(s)
+	}
+	if s.interval > 0 && now.Sub(s.logged) >= s.interval {
+		s.logged = now
+		s.logProgress()
+	}
+}
+
+// helper function returns the processing rate of the step in
+// rows per second.
+func (s *StepReport) rate() float64 {
+	elapsed := time.Since(s.started).Seconds()
+	if elapsed == 0 {
+		return 0
+	}
+	return float64(s.done) / elapsed
+}
+
+// helper function returns the estimated time until the step
+// completes, or zero if the number of expected rows is not
+// known.
+func (s *StepReport) eta() time.Duration {
+	rate := s.rate()
+	if s.expected <= s.done || rate == 0 {
+		return 0
+	}
+	remaining := float64(s.expected-s.done) / rate
+	return time.Duration(remaining * float64(time.Second))
+}
+
+// helper function logs the progress of the step.
+func (s *StepReport) logProgress() {
+	log := logrus.WithField("step", s.Step)
+	if s.expected == 0 {
+		log.Infof("processed %d rows, %.1f rows/s", s.done, s.rate())
+		return
+	}
+	log.Infof("processed %d of %d rows (%.1f%%), %.1f rows/s, eta %s",
+		s.done,
+		s.expected,
+		float64(s.done)/float64(s.expected)*100,
+		s.rate(),
+		s.eta().Round(time.Second),
+	)
+}
+
+// helper function returns the map keys in sorted order.
+func sortedKeys(m map[string]int64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -9,7 +9,6 @@ import (
 	"github.com/dchest/uniuri"
 	"github.com/drone/drone-go/drone"
 	"github.com/drone/go-scm/scm"
-	"github.com/hashicorp/go-multierror"
 	"github.com/russross/meddler"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/oauth2"
@@ -17,34 +16,66 @@ import (
 
 // MigrateRepos migrates the repositories from the V0
 // database to the V1 database.
-func MigrateRepos(source, target *sql.DB) error {
+func MigrateRepos(source, target *sql.DB, opts Options) (err error) {
+	task, err := beginTask(target, "migrate-repos", opts)
+	if err != nil {
+		return err
+	}
+	defer func() { task.end(err) }()
+
 	reposV0 := []*RepoV0{}
 
-	if err := meddler.QueryAll(source, &reposV0, repoImportQuery); err != nil {
+	if err := meddler.QueryAll(source, &reposV0, fmt.Sprintf(repoImportQuery, task.after())); err != nil {
 		return err
 	}
 
 	logrus.Infof("migrating %d repositories", len(reposV0))
+	task.expect(int64(len(reposV0)))
 
-	tx, err := target.Begin()
-
-	if err != nil {
+	if err := task.begin(); err != nil {
 		return err
 	}
 
-	defer tx.Rollback()
-
-	var sequence int64
 	for _, repoV0 := range reposV0 {
-		if repoV0.ID > sequence {
-			sequence = repoV0.ID
+		if !task.selected(repoV0.ID) {
+			continue
 		}
+		task.report.Read++
+		task.track(repoV0.ID)
 
 		log := logrus.WithFields(logrus.Fields{
 			"id":   repoV0.ID,
 			"repo": repoV0.FullName,
 		})
 
+		// when the step is synced, the repositories migrated
+		// by a previous run are refreshed, keeping the
+		// identifier, signer and secret of the target
+		// repository, which are not read from the source.
+		if task.refreshed(repoV0.ID) {
+			log.Debugln("refresh repository")
+			if err := task.update(repoV0.ID, log, repoRefreshStmt,
+				repoV0.Branch,
+				repoV0.IsPrivate,
+				repoV0.Visibility,
+				repoV0.IsActive,
+				repoV0.Config,
+				repoV0.IsTrusted,
+				repoV0.IsGated,
+				repoV0.Timeout,
+				int64(repoV0.Counter),
+				repoV0.AllowPull == false,
+				time.Now().Unix(),
+				repoV0.ID,
+			); err != nil {
+				return err
+			}
+			if err := task.progress(repoV0.ID); err != nil {
+				return err
+			}
+			continue
+		}
+
 		log.Debugln("migrate repository")
 
 		repoV1 := &RepoV1{
@@ -87,40 +118,63 @@ func MigrateRepos(source, target *sql.DB) error {
 			repoV1.IgnorePulls = true
 		}
 
-		if err := meddler.Insert(tx, "repos", repoV1); err != nil {
-			log.WithError(err).Errorln("migration failed")
+		if err := task.insert("repos", repoV0.ID, repoV1, log); err != nil {
+			return err
+		}
+		if err := task.progress(repoV0.ID); err != nil {
 			return err
 		}
 
 		log.Debugln("migration complete")
 	}
 
-	if meddler.Default == meddler.PostgreSQL {
-		_, err = tx.Exec(fmt.Sprintf(updateRepoSeq, sequence+1))
-		if err != nil {
-			logrus.WithError(err).Errorln("failed to reset sequence")
-			return err
-		}
+	if err := task.resetSequence(updateRepoSeq); err != nil {
+		return err
 	}
 
 	logrus.Infoln("migration complete")
-	return tx.Commit()
+	return task.commit()
 }
 
 // UpdateRepoIdentifiers updates the repository identifiers
 // from temporary values (assigned during migration) to the
 // value fetched from the source code management system.
-func UpdateRepoIdentifiers(db *sql.DB, client *scm.Client) error {
+func UpdateRepoIdentifiers(db *sql.DB, client *scm.Client, opts Options) (err error) {
+	ledger, err := startLedger(db, "update-repos", opts)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if !opts.DryRun {
+			failLedger(db, ledger, err)
+		}
+	}()
+
+	report := opts.step("update-repos")
+	failures := newFailureLog("update-repos", opts, report, ErrorSkip)
+	defer func() {
+		if err := failures.flush(db); err != nil {
+			logrus.WithError(err).Errorln("cannot update failure ledger")
+		}
+		report.finish()
+	}()
+
 	repos := []*RepoV1{}
-	var result error
 
 	if err := meddler.QueryAll(db, &repos, repoTempQuery); err != nil {
 		return err
 	}
+	report.expect(failures.expected(int64(len(repos))))
 
 	logrus.Infoln("updating repository metadata")
 
 	for _, repo := range repos {
+		if !failures.selected(repo.ID) {
+			continue
+		}
+		report.Read++
+		report.advance()
+
 		log := logrus.WithFields(logrus.Fields{
 			"repo": repo.Slug,
 		})
@@ -128,8 +182,9 @@ func UpdateRepoIdentifiers(db *sql.DB, client *scm.Client) error {
 		user := &UserV1{}
 
 		if err := meddler.QueryRow(db, user, fmt.Sprintf(userIdentifierQuery, repo.UserID)); err != nil {
-			log.WithError(err).Errorf("failed to get repository owner")
-			multierror.Append(result, err)
+			if err := failures.fail(repo.ID, "failed to get repository owner", err, log); err != nil {
+				return err
+			}
 			continue
 		}
 
@@ -147,42 +202,72 @@ func UpdateRepoIdentifiers(db *sql.DB, client *scm.Client) error {
 		remoteRepo, _, err := client.Repositories.Find(ctx, scm.Join(repo.Namespace, repo.Name))
 
 		if err != nil {
-			log.WithError(err).Errorf("failed to get remote repository")
-			multierror.Append(result, err)
+			if err := failures.fail(repo.ID, "failed to get remote repository", err, log); err != nil {
+				return err
+			}
 			continue
 		}
 
-		if _, err := db.Exec(fmt.Sprintf(repoUpdateQuery, remoteRepo.ID, repo.ID)); err != nil {
-			log.WithError(err).Errorf("failed to update metadata")
-			multierror.Append(result, err)
+		if opts.DryRun {
+			log.Infoln("dry run: skip metadata update")
+		} else if _, err := db.Exec(fmt.Sprintf(repoUpdateQuery, remoteRepo.ID, repo.ID)); err != nil {
+			if err := failures.fail(repo.ID, "failed to update metadata", err, log); err != nil {
+				return err
+			}
+			continue
 		}
 
+		ledger.Rows++
+		report.Updated++
+		failures.resolve(repo.ID)
 		log.Debugln("updated metadata")
 	}
 
+	if !opts.DryRun {
+		if err := finishLedger(db, ledger); err != nil {
+			return err
+		}
+	}
+
 	logrus.Infoln("repository metadata update complete")
-	return result
+	return nil
 }
 
 // ActivateRepositories re-activates the repositories.
 // This will create new webhooks and populate any empty
 // values (security keys, etc).
-func ActivateRepositories(db *sql.DB, client drone.Client) error {
+func ActivateRepositories(db *sql.DB, client drone.Client, opts Options) error {
+	report := opts.step("activate-repos")
+	failures := newFailureLog("activate-repos", opts, report, ErrorSkip)
+	defer func() {
+		if err := failures.flush(db); err != nil {
+			logrus.WithError(err).Errorln("cannot update failure ledger")
+		}
+		report.finish()
+	}()
+
 	repos := []*RepoV1{}
-	var result error
 
 	if err := meddler.QueryAll(db, &repos, repoActivateQuery); err != nil {
 		return err
 	}
+	report.expect(failures.expected(int64(len(repos))))
 
 	logrus.Infoln("begin repository activation")
 
 	for _, repo := range repos {
+		if !failures.selected(repo.ID) {
+			continue
+		}
+		report.Read++
+		report.advance()
+
 		log := logrus.WithFields(logrus.Fields{
 			"repo": repo.Slug,
 		})
 		if !repo.Active {
 			// https://discourse.drone.io/t/drone-migrates-repoactivatequery-is-invalid/5156
+			report.Skipped++
 			continue
 		}
 
@@ -191,13 +276,20 @@ func ActivateRepositories(db *sql.DB, client drone.Client) error {
 		user := &UserV1{}
 
 		if err := meddler.QueryRow(db, user, fmt.Sprintf(userIdentifierQuery, repo.UserID)); err != nil {
-			log.WithError(err).Errorf("failed to get repository owner")
-			multierror.Append(result, err)
+			if err := failures.fail(repo.ID, "failed to get repository owner", err, log); err != nil {
+				return err
+			}
 			continue
 		}
 
 		log = log.WithField("owner", user.Login)
 
+		if opts.DryRun {
+			log.Infoln("dry run: skip repository activation")
+			report.Updated++
+			continue
+		}
+
 		// make sure an entry exists in the permission table
 		// to ensure the user can activate the repository.
 		permV1 := &PermV1{
@@ -226,31 +318,59 @@ func ActivateRepositories(db *sql.DB, client drone.Client) error {
 		))
 
 		if _, err := client.RepoPost(repo.Namespace, repo.Name); err != nil {
-			log.WithError(err).Errorf("activation failed")
-			multierror.Append(result, err)
+			if err := failures.fail(repo.ID, "activation failed", err, log); err != nil {
+				return err
+			}
 			continue
 		}
 
+		report.Updated++
+		failures.resolve(repo.ID)
 		log.Debugln("successfully activated")
 	}
 
 	logrus.Infoln("repository activation complete")
-	return result
+	return nil
 }
 
 // RemoveRenamed removes repositories that have been renamed
 // or cannot be found in the remote system.
-func RemoveRenamed(db *sql.DB, client *scm.Client) error {
+func RemoveRenamed(db *sql.DB, client *scm.Client, opts Options) (err error) {
+	ledger, err := startLedger(db, "remove-renamed", opts)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if !opts.DryRun {
+			failLedger(db, ledger, err)
+		}
+	}()
+
+	report := opts.step("remove-renamed")
+	failures := newFailureLog("remove-renamed", opts, report, ErrorSkip)
+	defer func() {
+		if err := failures.flush(db); err != nil {
+			logrus.WithError(err).Errorln("cannot update failure ledger")
+		}
+		report.finish()
+	}()
+
 	repos := []*RepoV1{}
-	var result error
 
 	if err := meddler.QueryAll(db, &repos, repoTempQuery); err != nil {
 		return err
 	}
+	report.expect(failures.expected(int64(len(repos))))
 
 	logrus.Infoln("removing renamed repositories")
 
 	for _, repo := range repos {
+		if !failures.selected(repo.ID) {
+			continue
+		}
+		report.Read++
+		report.advance()
+
 		log := logrus.WithFields(logrus.Fields{
 			"repo": repo.Slug,
 		})
@@ -258,8 +378,9 @@ func RemoveRenamed(db *sql.DB, client *scm.Client) error {
 		user := &UserV1{}
 
 		if err := meddler.QueryRow(db, user, fmt.Sprintf(userIdentifierQuery, repo.UserID)); err != nil {
-			log.WithError(err).Errorf("failed to get repository owner")
-			multierror.Append(result, err)
+			if err := failures.fail(repo.ID, "failed to get repository owner", err, log); err != nil {
+				return err
+			}
 			continue
 		}
 
@@ -277,43 +398,83 @@ func RemoveRenamed(db *sql.DB, client *scm.Client) error {
 		remoteRepo, _, err := client.Repositories.Find(ctx, scm.Join(repo.Namespace, repo.Name))
 
 		if err != nil {
-			log.WithError(err).Errorf("failed to get remote repository")
-			multierror.Append(result, err)
+			if err := failures.fail(repo.ID, "failed to get remote repository", err, log); err != nil {
+				return err
+			}
 			continue
 		}
 
 		remoteName := scm.Join(remoteRepo.Namespace, remoteRepo.Name)
 		if remoteName == repo.Slug {
 			log.Debugln("skip repository, found in remote system")
+			report.Skipped++
 			continue
 		}
 
-		if _, err := db.Exec(fmt.Sprintf(deleteRepo, repo.ID)); err != nil {
-			log.WithError(err).Errorf("failed to remove repository")
-			multierror.Append(result, err)
+		if opts.DryRun {
+			log.Infoln("dry run: skip repository removal")
+		} else if _, err := db.Exec(fmt.Sprintf(deleteRepo, repo.ID)); err != nil {
+			if err := failures.fail(repo.ID, "failed to remove repository", err, log); err != nil {
+				return err
+			}
+			continue
 		}
 
+		ledger.Rows++
+		report.Deleted++
+		failures.resolve(repo.ID)
 		log.WithField("renamed", remoteName).
 			Debugln("renamed repository removed")
 	}
 
+	if !opts.DryRun {
+		if err := finishLedger(db, ledger); err != nil {
+			return err
+		}
+	}
+
 	logrus.Infoln("repository removal complete")
-	return result
+	return nil
 }
 
 // RemoveNotFound removes repositories that are not found
 // in the remote system.
-func RemoveNotFound(db *sql.DB, client *scm.Client) error {
+func RemoveNotFound(db *sql.DB, client *scm.Client, opts Options) (err error) {
+	ledger, err := startLedger(db, "remove-not-found", opts)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if !opts.DryRun {
+			failLedger(db, ledger, err)
+		}
+	}()
+
+	report := opts.step("remove-not-found")
+	failures := newFailureLog("remove-not-found", opts, report, ErrorSkip)
+	defer func() {
+		if err := failures.flush(db); err != nil {
+			logrus.WithError(err).Errorln("cannot update failure ledger")
+		}
+		report.finish()
+	}()
+
 	repos := []*RepoV1{}
-	var result error
 
 	if err := meddler.QueryAll(db, &repos, repoTempQuery); err != nil {
 		return err
 	}
+	report.expect(failures.expected(int64(len(repos))))
 
 	logrus.Infoln("removing not found repositories")
 
 	for _, repo := range repos {
+		if !failures.selected(repo.ID) {
+			continue
+		}
+		report.Read++
+		report.advance()
+
 		log := logrus.WithFields(logrus.Fields{
 			"repo": repo.Slug,
 		})
@@ -321,8 +482,9 @@ func RemoveNotFound(db *sql.DB, client *scm.Client) error {
 		user := &UserV1{}
 
 		if err := meddler.QueryRow(db, user, fmt.Sprintf(userIdentifierQuery, repo.UserID)); err != nil {
-			log.WithError(err).Errorf("failed to get repository owner")
-			multierror.Append(result, err)
+			if err := failures.fail(repo.ID, "failed to get repository owner", err, log); err != nil {
+				return err
+			}
 			continue
 		}
 
@@ -341,25 +503,41 @@ func RemoveNotFound(db *sql.DB, client *scm.Client) error {
 
 		if err == nil {
 			log.Debugln("skip repository, found in remote system")
+			report.Skipped++
 			continue
 		}
 
-		if _, err := db.Exec(fmt.Sprintf(deleteRepo, repo.ID)); err != nil {
-			log.WithError(err).Errorf("failed to remove repository")
-			multierror.Append(result, err)
+		if opts.DryRun {
+			log.Infoln("dry run: skip repository removal")
+		} else if _, err := db.Exec(fmt.Sprintf(deleteRepo, repo.ID)); err != nil {
+			if err := failures.fail(repo.ID, "failed to remove repository", err, log); err != nil {
+				return err
+			}
+			continue
 		}
 
+		ledger.Rows++
+		report.Deleted++
+		failures.resolve(repo.ID)
 		log.Debugln("not found repository removed")
 	}
 
+	if !opts.DryRun {
+		if err := finishLedger(db, ledger); err != nil {
+			return err
+		}
+	}
+
 	logrus.Infoln("repository removal complete")
-	return result
+	return nil
 }
 
 const repoImportQuery = `
 SELECT *
 FROM repos
 WHERE repo_user_id > 0
+  AND repo_id > %d
+ORDER BY repo_id
 `
 
 const repoTempQuery = `
@@ -385,9 +563,27 @@ SELECT *
 FROM repos
 `
 
+const repoRefreshStmt = `
+UPDATE repos
+SET
+ repo_branch = ?
+,repo_private = ?
+,repo_visibility = ?
+,repo_active = ?
+,repo_config = ?
+,repo_trusted = ?
+,repo_protected = ?
+,repo_timeout = ?
+,repo_counter = ?
+,repo_no_pulls = ?
+,repo_updated = ?
+WHERE repo_id = ?
+`
+
 const updateRepoSeq = `
-ALTER SEQUENCE repos_repo_id_seq
-RESTART WITH %d
+SELECT setval('repos_repo_id_seq', GREATEST(%d
+  ,(SELECT MAX(repo_id) FROM repos)
+  ,(SELECT last_value FROM repos_repo_id_seq)))
 `
 
 const deleteRepo = `
@@ -1,6 +1,7 @@
 package migrate
 
 import (
+	"crypto/cipher"
 	"database/sql"
 	"fmt"
 
@@ -10,27 +11,36 @@ import (
 
 // MigrateSecrets migrates the secrets V0 database
 // to the V1 database.
-func MigrateSecrets(source, target *sql.DB) error {
+func MigrateSecrets(source, target *sql.DB, opts Options) (err error) {
+	task, err := beginTask(target, "migrate-secrets", opts)
+	if err != nil {
+		return err
+	}
+	defer func() { task.end(err) }()
+
 	secretsV0 := []*SecretV0{}
 
-	if err := meddler.QueryAll(source, &secretsV0, secretImportQuery); err != nil {
+	if err := meddler.QueryAll(source, &secretsV0, fmt.Sprintf(secretImportQuery, task.after())); err != nil {
 		return err
 	}
 
-	logrus.Infof("migrating %d secrets", len(secretsV0))
-	tx, err := target.Begin()
-
+	block, err := secretCipher(target, opts)
 	if err != nil {
 		return err
 	}
 
-	defer tx.Rollback()
+	logrus.Infof("migrating %d secrets", len(secretsV0))
+	task.expect(int64(len(secretsV0)))
+	if err := task.begin(); err != nil {
+		return err
+	}
 
-	var sequence int64
 	for _, secretV0 := range secretsV0 {
-		if secretV0.ID > sequence {
-			sequence = secretV0.ID
+		if !task.selected(secretV0.ID) {
+			continue
 		}
+		task.report.Read++
+		task.track(secretV0.ID)
 
 		log := logrus.WithFields(logrus.Fields{
 			"repo":   secretV0.RepoID,
@@ -39,11 +49,16 @@ func MigrateSecrets(source, target *sql.DB) error {
 
 		log.Debugln("migrate secret")
 
+		data, err := sealSecret(block, secretV0.Value)
+		if err != nil {
+			return err
+		}
+
 		secretV1 := &SecretV1{
 			ID:     secretV0.ID,
 			RepoID: secretV0.RepoID,
 			Name:   secretV0.Name,
-			Data:   secretV0.Value,
+			Data:   data,
 		}
 
 		for _, event := range secretV0.Events {
@@ -53,35 +68,70 @@ func MigrateSecrets(source, target *sql.DB) error {
 			}
 		}
 
-		if err := meddler.Insert(tx, "secrets", secretV1); err != nil {
-			log.WithError(err).Errorln("migration failed")
+		// when the step is synced, secrets migrated by a
+		// previous run are refreshed, unless the identifier
+		// is used by a different secret of the target.
+		if task.refreshed(secretV0.ID) {
+			log.Debugln("refresh secret")
+			if err := task.update(secretV0.ID, log, secretRefreshStmt,
+				secretV1.Data,
+				secretV1.PullRequest,
+				secretV1.ID,
+				secretV1.RepoID,
+				secretV1.Name,
+			); err != nil {
+				return err
+			}
+		} else if err := task.insert("secrets", secretV0.ID, secretV1, log); err != nil {
+			return err
+		}
+		if err := task.progress(secretV0.ID); err != nil {
 			return err
 		}
 
 		log.Debugln("migration complete")
 	}
 
-	if meddler.Default == meddler.PostgreSQL {
-		_, err = tx.Exec(fmt.Sprintf(updateSecretsSeq, sequence+1))
-		if err != nil {
-			logrus.WithError(err).Errorln("failed to reset sequence")
-			return err
-		}
+	if err := task.resetSequence(updateSecretsSeq); err != nil {
+		return err
 	}
 
 	logrus.Infof("migration complete")
-	return tx.Commit()
+	return task.commit()
 }
 
 // EncryptSecrets is a helper function that encrypts all database
 // secrets after being inserted into the Drone database.
-func EncryptSecrets(target *sql.DB, key string) error {
+func EncryptSecrets(target *sql.DB, key string, opts Options) (err error) {
+	report := opts.step("encrypt-secrets")
+	defer report.finish()
+
 	block, err := parseKey(key)
 	if err != nil {
 		logrus.WithError(err).Errorln("cannot read encryption key")
 		return err
 	}
 
+	// the secrets are encrypted once, since secrets migrated
+	// after the secrets are encrypted are encrypted when they
+	// are inserted.
+	ledger, err := findLedger(target, "encrypt-secrets")
+	if err != nil {
+		return err
+	}
+	if ledger.Status == StatusSuccess {
+		return errSecretsEncrypted
+	}
+	ledger, err = startLedger(target, "encrypt-secrets", opts)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if !opts.DryRun {
+			failLedger(target, ledger, err)
+		}
+	}()
+
 	secretsV1 := []*SecretV1{}
 
 	if err := meddler.QueryAll(target, &secretsV1, secretListQuery); err != nil {
@@ -89,6 +139,8 @@ func EncryptSecrets(target *sql.DB, key string) error {
 	}
 
 	logrus.Infof("encrypting %d secrets", len(secretsV1))
+	report.Read += int64(len(secretsV1))
+	report.expect(int64(len(secretsV1)))
 	tx, err := target.Begin()
 
 	if err != nil {
@@ -103,21 +155,65 @@ func EncryptSecrets(target *sql.DB, key string) error {
 	}
 
 	for _, secretV1 := range secretsV1 {
+		report.advance()
 		ciphertext, err := encrypt(block, secretV1.Data)
 		if err != nil {
 			logrus.WithError(err).Errorln("encryption failed")
+			report.fail("encryption failed")
 			return err
 		}
 
 		secretV1.Data = string(ciphertext)
 		if _, err := tx.Exec(updateStmt, secretV1.Data, secretV1.ID); err != nil {
 			logrus.WithError(err).Errorln("update failed")
+			report.fail("update failed")
 			return err
 		}
 	}
 
+	if opts.DryRun {
+		logrus.Infoln("dry run: rolling back transaction")
+		report.Updated += int64(len(secretsV1))
+		return tx.Rollback()
+	}
+
+	ledger.Rows = int64(len(secretsV1))
+	if err := finishLedger(tx, ledger); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	report.Updated += int64(len(secretsV1))
 	logrus.Infof("encryption complete")
-	return tx.Commit()
+	return nil
+}
+
+// helper function returns the cipher with which migrated
+// secrets are encrypted, or nil if the secrets of the target
+// database are not encrypted. Once encrypt-secrets completes,
+// migrated secrets are encrypted, so that synced secrets do
+// not replace the encrypted secrets with plaintext.
+func secretCipher(target *sql.DB, opts Options) (cipher.Block, error) {
+	ledger, err := findLedger(target, "encrypt-secrets")
+	if err != nil || ledger.Status != StatusSuccess {
+		return nil, err
+	}
+	if opts.EncryptionKey == "" {
+		return nil, errEncryptionKey
+	}
+	return parseKey(opts.EncryptionKey)
+}
+
+// helper function encrypts the secret data with the cipher,
+// or returns the data if the cipher is nil.
+func sealSecret(block cipher.Block, data string) (string, error) {
+	if block == nil {
+		return data, nil
+	}
+	ciphertext, err := encrypt(block, data)
+	return string(ciphertext), err
 }
 
 const secretListQuery = `
@@ -130,6 +226,8 @@ SELECT secrets.*
 FROM secrets
 INNER JOIN repos ON secrets.secret_repo_id = repos.repo_id
 WHERE repos.repo_user_id > 0
+  AND secrets.secret_id > %d
+ORDER BY secrets.secret_id
 `
 
 const repoSlugQuery = `
@@ -139,8 +237,19 @@ WHERE repo_slug = '%s'
 `
 
 const updateSecretsSeq = `
-ALTER SEQUENCE secrets_secret_id_seq
-RESTART WITH %d
+SELECT setval('secrets_secret_id_seq', GREATEST(%d
+  ,(SELECT MAX(secret_id) FROM secrets)
+  ,(SELECT last_value FROM secrets_secret_id_seq)))
+`
+
+const secretRefreshStmt = `
+UPDATE secrets
+SET
+ secret_data = ?
+,secret_pull_request = ?
+WHERE secret_id = ?
+  AND secret_repo_id = ?
+  AND secret_name = ?
 `
 
 const updateSecretStmt = `
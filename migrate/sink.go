@@ -0,0 +1,37 @@
+package migrate
+
+// LogSink writes the migrated logs of a step.
+type LogSink interface {
+	// Name returns the name of the sink. The name is used to
+	// record the progress of the log migration.
+	Name() string
+
+	// Exists returns true if logs of the given size have
+	// already been written for the step.
+	Exists(step int64, size int) (bool, error)
+
+	// Write writes the logs for the step.
+	Write(step int64, data []byte) error
+
+	// Flush commits any buffered writes.
+	Flush() error
+
+	// Close releases the resources held by the sink. Writes
+	// that have not been flushed are discarded.
+	Close() error
+}
+
+// helper function closes the sink, and returns the error
+// if the step succeeded but the sink cannot be closed.
+func closeSink(sink LogSink, err *error) {
+	if cerr := sink.Close(); *err == nil {
+		*err = cerr
+	}
+}
+
+// ledgerSink is implemented by sinks that write to the
+// target database, so that the progress is recorded in the
+// same transaction as the logs.
+type ledgerSink interface {
+	flushLedger(ledger *Ledger) error
+}
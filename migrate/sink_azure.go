@@ -0,0 +1,93 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+// AzureConfig configures the Azure Blob log sink.
+type AzureConfig struct {
+	// AccountName is the storage account name.
+	AccountName string
+
+	// AccountKey is the storage account key.
+	AccountKey string
+
+	// Container is the name of the container.
+	Container string
+
+	// Prefix is the optional blob name prefix.
+	Prefix string
+
+	// Endpoint is the optional blob service endpoint, such as
+	// http://127.0.0.1:10000/devstoreaccount1 for Azurite.
+	// Defaults to https://<account>.blob.core.windows.net.
+	Endpoint string
+}
+
+// NewAzureSink returns a log sink that uploads logs to an
+// Azure Blob Storage container.
+func NewAzureSink(config AzureConfig) (LogSink, error) {
+	credential, err := azblob.NewSharedKeyCredential(config.AccountName, config.AccountKey)
+	if err != nil {
+		return nil, err
+	}
+	endpoint := config.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://%s.blob.core.windows.net", config.AccountName)
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = path.Join(u.Path, config.Container)
+
+	pipeline := azblob.NewPipeline(credential, azblob.PipelineOptions{})
+	return &azureSink{
+		prefix:    config.Prefix,
+		container: azblob.NewContainerURL(*u, pipeline),
+	}, nil
+}
+
+type azureSink struct {
+	prefix    string
+	container azblob.ContainerURL
+}
+
+func (s *azureSink) Name() string {
+	return "azure"
+}
+
+func (s *azureSink) Exists(step int64, size int) (bool, error) {
+	props, err := s.blob(step).GetProperties(context.Background(), azblob.BlobAccessConditions{})
+	if serr, ok := err.(azblob.StorageError); ok && serr.Response().StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return props.ContentLength() == int64(size), nil
+}
+
+func (s *azureSink) Write(step int64, data []byte) error {
+	_, err := azblob.UploadBufferToBlockBlob(context.Background(), data, s.blob(step), azblob.UploadToBlockBlobOptions{})
+	return err
+}
+
+func (s *azureSink) Flush() error {
+	return nil
+}
+
+func (s *azureSink) Close() error {
+	return nil
+}
+
+// helper function returns the blob url of the step logs.
+func (s *azureSink) blob(step int64) azblob.BlockBlobURL {
+	return s.container.NewBlockBlobURL(path.Join(s.prefix, fmt.Sprint(step)))
+}
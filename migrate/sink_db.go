@@ -0,0 +1,135 @@
+package migrate
+
+import (
+	"database/sql"
+	"sync"
+)
+
+// NewDatabaseSink returns a log sink that writes logs to the
+// logs table of the V1 database. Logs are written in a single
+// transaction that is committed when the sink is flushed.
+// Logs that conflict with existing logs are written using the
+// conflict policy. Unless failed logs abort the migration step,
+// each log is written in a savepoint, so that the transaction
+// can continue after a failed write.
+func NewDatabaseSink(db *sql.DB, policy ConflictPolicy, onError ErrorPolicy) LogSink {
+	return &databaseSink{
+		db:        db,
+		policy:    policy,
+		savepoint: onError != "" && onError != ErrorAbort,
+	}
+}
+
+type databaseSink struct {
+	sync.Mutex
+	db        *sql.DB
+	tx        *sql.Tx
+	policy    ConflictPolicy
+	savepoint bool
+}
+
+func (s *databaseSink) Name() string {
+	return "db"
+}
+
+func (s *databaseSink) Exists(step int64, size int) (bool, error) {
+	var length sql.NullInt64
+	err := s.db.QueryRow(rebind(logsLengthQuery), step).Scan(&length)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return length.Int64 == int64(size), err
+}
+
+func (s *databaseSink) Write(step int64, data []byte) error {
+	s.Lock()
+	defer s.Unlock()
+	if err := s.begin(); err != nil {
+		return err
+	}
+	logs := &LogsV1{
+		ID:   step,
+		Data: data,
+	}
+	if !s.savepoint {
+		_, err := insertRow(s.tx, "logs", logs, s.policy)
+		return err
+	}
+	if _, err := s.tx.Exec("SAVEPOINT migrate_log"); err != nil {
+		return err
+	}
+	if _, err := insertRow(s.tx, "logs", logs, s.policy); err != nil {
+		if _, err := s.tx.Exec("ROLLBACK TO SAVEPOINT migrate_log"); err != nil {
+			return err
+		}
+		return err
+	}
+	_, err := s.tx.Exec("RELEASE SAVEPOINT migrate_log")
+	return err
+}
+
+func (s *databaseSink) Flush() error {
+	s.Lock()
+	defer s.Unlock()
+	return s.commit()
+}
+
+// Close rolls back the transaction in progress, if the sink
+// was not flushed.
+func (s *databaseSink) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.tx == nil {
+		return nil
+	}
+	err := s.tx.Rollback()
+	s.tx = nil
+	return err
+}
+
+// flushLedger records the progress in the transaction, and
+// commits the transaction.
+func (s *databaseSink) flushLedger(ledger *Ledger) error {
+	s.Lock()
+	defer s.Unlock()
+	if err := s.begin(); err != nil {
+		return err
+	}
+	if err := saveLedger(s.tx, ledger); err != nil {
+		return err
+	}
+	return s.commit()
+}
+
+// helper function begins a transaction, if a transaction
+// is not already in progress.
+func (s *databaseSink) begin() error {
+	if s.tx != nil {
+		return nil
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	s.tx = tx
+	return nil
+}
+
+// helper function commits the transaction in progress.
+func (s *databaseSink) commit() error {
+	if s.tx == nil {
+		return nil
+	}
+	err := s.tx.Commit()
+	if err != nil {
+		s.tx.Rollback()
+	}
+	s.tx = nil
+	return err
+}
+
+const logsLengthQuery = `
+SELECT LENGTH(log_data)
+FROM logs
+WHERE log_id = ?
+`
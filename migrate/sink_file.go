@@ -0,0 +1,69 @@
+package migrate
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// NewFileSink returns a log sink that writes logs to a local
+// directory tree. The logs are sharded by the step id, so that
+// a directory holds at most 1000 files or directories.
+func NewFileSink(dir string) LogSink {
+	return &fileSink{dir: dir}
+}
+
+type fileSink struct {
+	dir string
+}
+
+func (s *fileSink) Name() string {
+	return "file"
+}
+
+func (s *fileSink) Exists(step int64, size int) (bool, error) {
+	info, err := os.Stat(s.path(step))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return info.Size() == int64(size), nil
+}
+
+// Write writes the logs to a temporary file that is renamed
+// when complete, so that a partially written file is never
+// mistaken for a complete one.
+func (s *fileSink) Write(step int64, data []byte) error {
+	path := s.path(step)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (s *fileSink) Flush() error {
+	return nil
+}
+
+func (s *fileSink) Close() error {
+	return nil
+}
+
+// helper function returns the file path of the step logs,
+// in the format <dir>/<millions>/<thousands>/<step id>. For
+// example, the logs of step 1234567 are written to
+// <dir>/001/234/1234567.
+func (s *fileSink) path(step int64) string {
+	return filepath.Join(s.dir,
+		fmt.Sprintf("%03d", step/1000000),
+		fmt.Sprintf("%03d", step/1000%1000),
+		fmt.Sprint(step),
+	)
+}
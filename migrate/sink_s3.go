@@ -0,0 +1,241 @@
+package migrate
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// S3Config configures the S3 log sink.
+type S3Config struct {
+	// Bucket is the name of the bucket.
+	Bucket string
+
+	// Prefix is the optional key prefix.
+	Prefix string
+
+	// Endpoint is the optional endpoint of an S3-compatible
+	// storage server, such as MinIO.
+	Endpoint string
+
+	// PathStyle uses path-style addressing instead of
+	// virtual-hosted-style addressing.
+	PathStyle bool
+
+	// DisableSSL connects to the endpoint without TLS.
+	DisableSSL bool
+
+	// Encryption is the optional server-side encryption
+	// algorithm, such as AES256 or aws:kms.
+	Encryption string
+
+	// StorageClass is the optional storage class.
+	StorageClass string
+
+	// Compress gzip compresses the logs before they are
+	// uploaded, and sets the Content-Encoding of the object.
+	// The 1.x server must be able to read gzip encoded logs.
+	Compress bool
+
+	// Verify downloads each uploaded object, and compares the
+	// size and checksums of the stored object with the logs.
+	Verify bool
+
+	// Manifest is the optional path of a file to which the
+	// key and checksums of each uploaded object are appended.
+	Manifest string
+}
+
+// NewS3Sink returns a log sink that uploads logs to an S3 or
+// S3-compatible bucket. The client authenticates using the
+// standard aws authentication methods.
+func NewS3Sink(config S3Config) (LogSink, error) {
+	sess, err := session.NewSession(&aws.Config{
+		Endpoint:         aws.String(config.Endpoint),
+		DisableSSL:       aws.Bool(config.DisableSSL),
+		S3ForcePathStyle: aws.Bool(config.PathStyle),
+	})
+	if err != nil {
+		return nil, err
+	}
+	sink := &s3Sink{
+		config: config,
+		client: s3.New(sess),
+	}
+	if config.Manifest != "" {
+		sink.manifest, err = openManifest(config.Manifest)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return sink, nil
+}
+
+type s3Sink struct {
+	config   S3Config
+	client   *s3.S3
+	manifest *manifest
+}
+
+func (s *s3Sink) Name() string {
+	return "s3"
+}
+
+func (s *s3Sink) Exists(step int64, size int) (bool, error) {
+	head, err := s.client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(s.config.Bucket),
+		Key:    aws.String(s3key(s.config.Prefix, step)),
+	})
+	if aerr, ok := err.(awserr.RequestFailure); ok && aerr.StatusCode() == http.StatusNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	// compressed objects record the size of the logs before
+	// compression in the object metadata.
+	if v, ok := metadata(head.Metadata, "size"); ok {
+		return v == strconv.Itoa(size), nil
+	}
+	return aws.Int64Value(head.ContentLength) == int64(size), nil
+}
+
+func (s *s3Sink) Write(step int64, data []byte) error {
+	key := s3key(s.config.Prefix, step)
+	entry := &manifestEntry{
+		Step: step,
+		Key:  key,
+		Size: len(data),
+	}
+
+	body := data
+	if s.config.Compress {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(data); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		body = buf.Bytes()
+		entry.Encoding = "gzip"
+	}
+
+	md5sum := md5.Sum(body)
+	shasum := sha256.Sum256(body)
+	entry.MD5 = hex.EncodeToString(md5sum[:])
+	entry.SHA256 = hex.EncodeToString(shasum[:])
+
+	// the Content-MD5 header is verified by the server, which
+	// rejects the upload if the object is corrupted in transit.
+	input := &s3.PutObjectInput{
+		ACL:        aws.String("private"),
+		Bucket:     aws.String(s.config.Bucket),
+		Key:        aws.String(key),
+		Body:       bytes.NewReader(body),
+		ContentMD5: aws.String(base64.StdEncoding.EncodeToString(md5sum[:])),
+		Metadata: map[string]*string{
+			"sha256": aws.String(entry.SHA256),
+			"size":   aws.String(strconv.Itoa(entry.Size)),
+		},
+	}
+	if s.config.Compress {
+		input.ContentEncoding = aws.String("gzip")
+	}
+	if s.config.Encryption != "" {
+		input.ServerSideEncryption = aws.String(s.config.Encryption)
+	}
+	if s.config.StorageClass != "" {
+		input.StorageClass = aws.String(s.config.StorageClass)
+	}
+	if _, err := s.client.PutObject(input); err != nil {
+		return err
+	}
+	metrics.upload(len(body))
+
+	if s.config.Verify {
+		if err := s.verify(entry, len(body)); err != nil {
+			return err
+		}
+	}
+	if s.manifest != nil {
+		return s.manifest.add(entry)
+	}
+	return nil
+}
+
+func (s *s3Sink) Flush() error {
+	if s.manifest != nil {
+		return s.manifest.flush()
+	}
+	return nil
+}
+
+func (s *s3Sink) Close() error {
+	if s.manifest != nil {
+		return s.manifest.close()
+	}
+	return nil
+}
+
+// helper function downloads the uploaded object, and compares
+// the size and sha256 checksum of the stored bytes with the
+// manifest entry. The object is requested with an explicit
+// Accept-Encoding header, which prevents the http client from
+// decompressing gzip encoded objects. The ETag is also
+// compared if it is the MD5 of the object, which is not the
+// case for objects encrypted with aws:kms.
+func (s *s3Sink) verify(entry *manifestEntry, size int) error {
+	req, out := s.client.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(s.config.Bucket),
+		Key:    aws.String(entry.Key),
+	})
+	req.HTTPRequest.Header.Set("Accept-Encoding", "gzip")
+	if err := req.Send(); err != nil {
+		return err
+	}
+	defer out.Body.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, out.Body)
+	if err != nil {
+		return err
+	}
+	if n != int64(size) {
+		return fmt.Errorf("s3: object %s size mismatch: uploaded %d bytes, found %d bytes", entry.Key, size, n)
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != entry.SHA256 {
+		return fmt.Errorf("s3: object %s sha256 mismatch: uploaded %s, found %s", entry.Key, entry.SHA256, sum)
+	}
+	etag := strings.Trim(aws.StringValue(out.ETag), `"`)
+	if len(etag) == md5.Size*2 && s.config.Encryption != "aws:kms" && etag != entry.MD5 {
+		return fmt.Errorf("s3: object %s md5 mismatch: uploaded %s, found %s", entry.Key, entry.MD5, etag)
+	}
+	return nil
+}
+
+// helper function returns the named object metadata. The
+// metadata keys returned by the server are canonicalized, so
+// the keys are compared without regard to case.
+func metadata(m map[string]*string, name string) (string, bool) {
+	for k, v := range m {
+		if strings.EqualFold(k, name) {
+			return aws.StringValue(v), true
+		}
+	}
+	return "", false
+}
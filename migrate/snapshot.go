@@ -0,0 +1,508 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+	"github.com/sirupsen/logrus"
+)
+
+// Snapshot is a read only view of the V0 database at a single
+// point in time. Every connection of the snapshot database
+// reads the same snapshot, so that the migration steps see a
+// consistent V0 database while the V0 server is running.
+type Snapshot struct {
+	// DB is the snapshot database, which is used as the
+	// source database of the migration steps.
+	DB *sql.DB
+
+	close func() error
+}
+
+// OpenSnapshot takes a snapshot of the V0 database. Postgres
+// connections import a snapshot exported by a transaction that
+// is held open until the snapshot is closed. Mysql connections
+// are opened inside a global read lock, each with a consistent
+// snapshot transaction, and the number of connections is fixed.
+// Sqlite databases are copied with the backup api. Reads of
+// the snapshot are throttled like reads of the V0 database.
+func OpenSnapshot(driverName, datasource string, opts Options) (*Snapshot, error) {
+	switch driverName {
+	case "postgres":
+		return openPostgresSnapshot(datasource, opts)
+	case "mysql":
+		return openMysqlSnapshot(datasource, opts.logWorkers()+2, opts)
+	case "sqlite3":
+		return openSqliteSnapshot(datasource, opts)
+	default:
+		return nil, fmt.Errorf("cannot snapshot database driver %s", driverName)
+	}
+}
+
+// Close releases the snapshot.
+func (s *Snapshot) Close() error {
+	return s.close()
+}
+
+// helper function opens a postgres snapshot. The snapshot is
+// exported by a repeatable read transaction, and imported by
+// every connection of the snapshot database.
+func openPostgresSnapshot(datasource string, opts Options) (*Snapshot, error) {
+	base, err := sql.Open("postgres", datasource)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := base.BeginTx(context.Background(), &sql.TxOptions{
+		Isolation: sql.LevelRepeatableRead,
+		ReadOnly:  true,
+	})
+	if err != nil {
+		base.Close()
+		return nil, err
+	}
+	var id string
+	if err := tx.QueryRow("SELECT pg_export_snapshot()").Scan(&id); err != nil {
+		tx.Rollback()
+		base.Close()
+		return nil, err
+	}
+	logrus.WithField("snapshot", id).Infoln("exported source database snapshot")
+
+	db := sql.OpenDB(opts.Throttle.connector(&snapshotConnector{
+		driver:     base.Driver(),
+		datasource: datasource,
+		init: []string{
+			"BEGIN ISOLATION LEVEL REPEATABLE READ READ ONLY",
+			fmt.Sprintf("SET TRANSACTION SNAPSHOT '%s'", id),
+		},
+		// a failed statement aborts the snapshot transaction,
+		// so the connection cannot be reused.
+		discard: true,
+	}))
+	return &Snapshot{
+		DB: db,
+		close: func() error {
+			db.Close()
+			tx.Rollback()
+			return base.Close()
+		},
+	}, nil
+}
+
+// helper function opens a mysql snapshot. Mysql snapshots
+// cannot be shared between connections, so a fixed number of
+// connections start a consistent snapshot transaction while
+// a global read lock is held, and no further connections are
+// opened.
+func openMysqlSnapshot(datasource string, conns int, opts Options) (*Snapshot, error) {
+	ctx := context.Background()
+	base, err := sql.Open("mysql", datasource)
+	if err != nil {
+		return nil, err
+	}
+	defer base.Close()
+
+	lock, err := base.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Close()
+	if _, err := lock.ExecContext(ctx, "FLUSH TABLES WITH READ LOCK"); err != nil {
+		return nil, fmt.Errorf("cannot lock source database: %s", err)
+	}
+	defer lock.ExecContext(ctx, "UNLOCK TABLES")
+
+	connector := &snapshotConnector{
+		driver:     base.Driver(),
+		datasource: datasource,
+		init: []string{
+			"SET SESSION TRANSACTION ISOLATION LEVEL REPEATABLE READ",
+			"START TRANSACTION WITH CONSISTENT SNAPSHOT",
+		},
+	}
+	db := sql.OpenDB(opts.Throttle.connector(connector))
+	db.SetMaxOpenConns(conns)
+	db.SetMaxIdleConns(conns)
+
+	// a connection closed by the pool cannot be replaced, so
+	// the connections are never closed for being idle or old.
+	db.SetConnMaxLifetime(0)
+	db.SetConnMaxIdleTime(0)
+
+	// the connections are opened, and then returned to the
+	// pool, which keeps them open until the snapshot is closed.
+	opened := make([]*sql.Conn, 0, conns)
+	defer func() {
+		for _, conn := range opened {
+			conn.Close()
+		}
+	}()
+	for i := 0; i < conns; i++ {
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		opened = append(opened, conn)
+	}
+	connector.seal(shrinkPool(db))
+	logrus.WithField("connections", conns).Infoln("started source database snapshot")
+
+	return &Snapshot{
+		DB: db,
+		close: func() error {
+			// the connections closed with the snapshot are
+			// not lost.
+			connector.seal(nil)
+			return db.Close()
+		},
+	}, nil
+}
+
+// helper function opens a sqlite snapshot, which is a copy of
+// the database in a temporary directory that is removed when
+// the snapshot is closed.
+func openSqliteSnapshot(datasource string, opts Options) (*Snapshot, error) {
+	dir, err := ioutil.TempDir("", "drone-migrate")
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, "snapshot.sqlite")
+	if err := backupSqlite(datasource, path); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	logrus.WithField("path", path).Infoln("copied source database snapshot")
+
+	db, err := OpenSource("sqlite3", path, opts)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return &Snapshot{
+		DB: db,
+		close: func() error {
+			db.Close()
+			return os.RemoveAll(dir)
+		},
+	}, nil
+}
+
+// helper function copies the sqlite database to the path
+// using the backup api, which copies the database in a single
+// step, so that the copy is consistent.
+func backupSqlite(datasource, path string) error {
+	ctx := context.Background()
+	src, err := sql.Open("sqlite3", datasource)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	srcConn, err := src.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+	dstConn, err := dst.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer dstConn.Close()
+
+	return dstConn.Raw(func(dstRaw interface{}) error {
+		return srcConn.Raw(func(srcRaw interface{}) error {
+			backup, err := dstRaw.(*sqlite3.SQLiteConn).Backup("main", srcRaw.(*sqlite3.SQLiteConn), "main")
+			if err != nil {
+				return err
+			}
+			for {
+				// the step is retried while the source
+				// database is locked by a writer. The driver
+				// reports a locked database as an incomplete
+				// step, or as a busy or locked error.
+				done, err := backup.Step(-1)
+				if err != nil && !sqliteBusy(err) {
+					backup.Finish()
+					return err
+				}
+				if done {
+					return backup.Finish()
+				}
+				logrus.Debugln("source database is locked, retrying snapshot")
+				time.Sleep(backupRetry)
+			}
+		})
+	})
+}
+
+// backupRetry is the pause before the backup of a locked
+// sqlite database is retried.
+const backupRetry = 100 * time.Millisecond
+
+// helper function returns true if the sqlite error reports
+// that the database is busy or locked.
+func sqliteBusy(err error) bool {
+	if serr, ok := err.(sqlite3.Error); ok {
+		return serr.Code == sqlite3.ErrBusy || serr.Code == sqlite3.ErrLocked
+	}
+	return false
+}
+
+// errSnapshotSealed is returned when a connection is opened
+// after the connections of a mysql snapshot are started, which
+// happens once every connection of the snapshot is lost, for
+// example closed by the server after the wait_timeout.
+var errSnapshotSealed = errors.New("all connections to the source database snapshot are lost, re-run the command to take a new snapshot")
+
+// snapshotConnector opens connections that execute the init
+// statements, which start the snapshot transaction, before
+// the connection is used.
+type snapshotConnector struct {
+	driver     driver.Driver
+	datasource string
+	init       []string
+
+	// discard is true if a connection on which a statement
+	// failed is discarded instead of returned to the pool.
+	discard bool
+
+	sync.Mutex
+	sealed bool
+	open   int
+
+	// lost is called with the number of open connections when
+	// a connection is closed after the connector is sealed.
+	lost func(open int)
+}
+
+func (c *snapshotConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.sealed {
+		logrus.Errorln("cannot replace a lost connection to the source database snapshot")
+		return nil, errSnapshotSealed
+	}
+	conn, err := c.driver.Open(c.datasource)
+	if err != nil {
+		return nil, err
+	}
+	for _, stmt := range c.init {
+		if err := execConn(ctx, conn, stmt); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	c.open++
+	return &snapshotConn{Conn: conn, connector: c}, nil
+}
+
+func (c *snapshotConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// helper function prevents further connections from being
+// opened. The lost function is called when a connection is
+// closed, and may be nil.
+func (c *snapshotConnector) seal(lost func(open int)) {
+	c.Lock()
+	c.sealed = true
+	c.lost = lost
+	c.Unlock()
+}
+
+// helper function returns a function that shrinks the pool
+// when a connection of a sealed connector is lost, so that the
+// steps wait for the remaining connections instead of failing
+// to open a new connection.
+func shrinkPool(db *sql.DB) func(open int) {
+	return func(open int) {
+		logrus.WithField("connections", open).
+			Warnln("lost a connection to the source database snapshot")
+		if open > 0 {
+			db.SetMaxOpenConns(open)
+		}
+	}
+}
+
+// helper function records a closed connection.
+func (c *snapshotConnector) closed() {
+	c.Lock()
+	c.open--
+	open, lost := c.open, c.lost
+	c.Unlock()
+	if lost != nil {
+		lost(open)
+	}
+}
+
+// snapshotConn is a connection of the snapshot database,
+// which records when it is closed, and whether a statement
+// failed. The query is executed by a prepared statement if
+// the driver connection does not execute queries directly.
+type snapshotConn struct {
+	driver.Conn
+	connector *snapshotConnector
+	failed    bool
+}
+
+func (c *snapshotConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	rows, err := queryer.QueryContext(ctx, query, args)
+	if err != nil {
+		c.fail(err)
+		return nil, err
+	}
+	return &snapshotRows{Rows: rows, conn: c}, nil
+}
+
+func (c *snapshotConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	res, err := execer.ExecContext(ctx, query, args)
+	c.fail(err)
+	return res, err
+}
+
+func (c *snapshotConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	var stmt driver.Stmt
+	var err error
+	if preparer, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		stmt, err = preparer.PrepareContext(ctx, query)
+	} else {
+		stmt, err = c.Conn.Prepare(query)
+	}
+	if err != nil {
+		c.fail(err)
+		return nil, err
+	}
+	return &snapshotStmt{Stmt: stmt, conn: c}, nil
+}
+
+func (c *snapshotConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if checker, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+func (c *snapshotConn) ResetSession(ctx context.Context) error {
+	if !c.IsValid() {
+		return driver.ErrBadConn
+	}
+	if resetter, ok := c.Conn.(driver.SessionResetter); ok {
+		return resetter.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *snapshotConn) IsValid() bool {
+	return !c.failed || !c.connector.discard
+}
+
+func (c *snapshotConn) Close() error {
+	err := c.Conn.Close()
+	c.connector.closed()
+	return err
+}
+
+// helper function records a failed statement. The end of the
+// result set is not a failure.
+func (c *snapshotConn) fail(err error) {
+	if err != nil && err != io.EOF && err != driver.ErrSkip {
+		c.failed = true
+	}
+}
+
+// snapshotStmt is a prepared statement of a snapshot
+// connection, which records whether the statement failed.
+type snapshotStmt struct {
+	driver.Stmt
+	conn *snapshotConn
+}
+
+func (s *snapshotStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	var res driver.Result
+	var err error
+	if execer, ok := s.Stmt.(driver.StmtExecContext); ok {
+		res, err = execer.ExecContext(ctx, args)
+	} else {
+		res, err = s.Stmt.Exec(namedValues(args))
+	}
+	s.conn.fail(err)
+	return res, err
+}
+
+func (s *snapshotStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	var rows driver.Rows
+	var err error
+	if queryer, ok := s.Stmt.(driver.StmtQueryContext); ok {
+		rows, err = queryer.QueryContext(ctx, args)
+	} else {
+		rows, err = s.Stmt.Query(namedValues(args))
+	}
+	if err != nil {
+		s.conn.fail(err)
+		return nil, err
+	}
+	return &snapshotRows{Rows: rows, conn: s.conn}, nil
+}
+
+// snapshotRows is a result set of a snapshot connection,
+// which records whether reading the result set failed.
+type snapshotRows struct {
+	driver.Rows
+	conn *snapshotConn
+}
+
+func (r *snapshotRows) Next(dest []driver.Value) error {
+	err := r.Rows.Next(dest)
+	r.conn.fail(err)
+	return err
+}
+
+// helper function converts the named arguments to the values
+// of a driver that does not support named arguments.
+func namedValues(args []driver.NamedValue) []driver.Value {
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		values[i] = arg.Value
+	}
+	return values
+}
+
+// helper function executes the statement on the driver
+// connection.
+func execConn(ctx context.Context, conn driver.Conn, query string) error {
+	if execer, ok := conn.(driver.ExecerContext); ok {
+		_, err := execer.ExecContext(ctx, query, nil)
+		return err
+	}
+	stmt, err := conn.Prepare(query)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(nil)
+	return err
+}
@@ -0,0 +1,101 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"testing"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+func TestSnapshotLostConnections(t *testing.T) {
+	ctx := context.Background()
+	connector := &snapshotConnector{
+		driver:     &sqlite3.SQLiteDriver{},
+		datasource: fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name()),
+	}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+	db.SetMaxOpenConns(2)
+	db.SetMaxIdleConns(2)
+
+	var conns []*sql.Conn
+	for i := 0; i < 2; i++ {
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, conn)
+	}
+	for _, conn := range conns {
+		conn.Close()
+	}
+	connector.seal(shrinkPool(db))
+
+	// the pool waits for the remaining connection instead of
+	// opening a new connection.
+	lose(t, db)
+	if got := db.Stats().MaxOpenConnections; got != 1 {
+		t.Errorf("want pool shrunk to 1 connection, got %d", got)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := db.Exec("SELECT 1"); err != nil {
+			t.Fatalf("want query on the remaining connection, got %s", err)
+		}
+	}
+
+	lose(t, db)
+	if _, err := db.Exec("SELECT 1"); err != errSnapshotSealed {
+		t.Errorf("want error %q once all connections are lost, got %v", errSnapshotSealed, err)
+	}
+}
+
+// helper function closes a connection of the pool as if it
+// was closed by the server.
+func lose(t *testing.T, db *sql.DB) {
+	t.Helper()
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+	conn.Close()
+}
+
+func TestSnapshotFailedConnections(t *testing.T) {
+	tests := []struct {
+		discard bool
+		want    int
+	}{
+		{discard: true, want: 0},
+		{discard: false, want: 1},
+	}
+	for _, test := range tests {
+		// each connection has its own temporary table, which
+		// stands in for the snapshot transaction.
+		db := sql.OpenDB(&snapshotConnector{
+			driver:     &sqlite3.SQLiteDriver{},
+			datasource: ":memory:",
+			init:       []string{"CREATE TEMP TABLE session (id INTEGER)"},
+			discard:    test.discard,
+		})
+		db.SetMaxOpenConns(1)
+
+		if _, err := db.Exec("INSERT INTO session (id) VALUES (1)"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Exec("SELECT * FROM missing"); err == nil {
+			t.Fatalf("want query of a missing table to fail")
+		}
+		var got int
+		if err := db.QueryRow("SELECT COUNT(*) FROM session").Scan(&got); err != nil {
+			t.Fatal(err)
+		}
+		if got != test.want {
+			t.Errorf("discard %v: want %d rows in the session of the next query, got %d", test.discard, test.want, got)
+		}
+		db.Close()
+	}
+}
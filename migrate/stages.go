@@ -2,57 +2,80 @@ package migrate
 
 import (
 	"database/sql"
-	"fmt"
+	"sort"
+	"strings"
 
-	"github.com/russross/meddler"
 	"github.com/sirupsen/logrus"
 )
 
 // MigrateStages migrates the stages from the V0
 // database to the V1 database.
-func MigrateStages(source, target *sql.DB) error {
-	stagesV0 := []*StageV0{}
-
-	// 1. load all repos from the V0 database.
-	err := meddler.QueryAll(source, &stagesV0, stageListQuery)
+func MigrateStages(source, target *sql.DB, opts Options) (err error) {
+	task, err := beginTask(target, "migrate-stages", opts)
 	if err != nil {
 		return err
 	}
+	defer func() { task.end(err) }()
 
-	logrus.Infof("migrating %d stages", len(stagesV0))
+	logrus.Infoln("migrating stages")
+	task.count(source, stageCountQuery)
+	if err := task.mark(source, procWatermarkQuery); err != nil {
+		return err
+	}
 
-	// 2. create a database transaction so that we
+	// 1. create a database transaction so that we
 	// can rollback if the data migration fails.
-	tx, err := target.Begin()
-	if err != nil {
+	if err := task.begin(); err != nil {
 		return err
 	}
-	defer tx.Rollback()
 
-	// 3. iterate through the list and convert from
-	// the 0.x to the 1.x structure and insert.
-	var sequence int64
-	for _, stageV0 := range stagesV0 {
-		if stageV0.ID > sequence {
-			sequence = stageV0.ID
+	// 2. iterate through the V0 stages one page at a
+	// time, convert from the 0.x to the 1.x structure
+	// and insert.
+	migrate := func(rows *sql.Rows) (int64, error) {
+		stageV0 := &StageV0{}
+		if err := scanRow(rows, stageV0); err != nil {
+			return 0, err
+		}
+		if !task.selected(stageV0.ID) {
+			return stageV0.ID, nil
+		}
+		task.report.Read++
+		task.track(stageV0.ID)
+
+		log := logrus.
+			WithField("build", stageV0.BuildID).
+			WithField("stage", stageV0.PID)
+		log.Debugln("migrate stage")
+
+		// stages are numbered from 1 within the build, while
+		// the 0.8 process identifiers are shared with the
+		// steps of the build.
+		os, arch, variant, ok := parsePlatform(stageV0.Platform)
+		if !ok {
+			task.warn(log, "stage platform defaulted")
+		}
+		if len(variant) > maxVariant {
+			variant = ""
+			task.warn(log, "stage platform variant dropped")
 		}
 
 		stageV1 := &StageV1{
 			ID:        stageV0.ID,
-			RepoID:    0,
+			RepoID:    stageV0.RepoID,
 			BuildID:   stageV0.BuildID,
-			Number:    stageV0.PID,
+			Number:    stageV0.Number,
 			Name:      stageV0.Name,
-			Kind:      "",
-			Type:      "",
+			Kind:      stageKind,
+			Type:      stageType,
 			Status:    stageV0.State,
 			Error:     stageV0.Error,
 			ErrIgnore: false,
 			ExitCode:  stageV0.ExitCode,
 			Machine:   stageV0.Machine,
-			OS:        "linux",
-			Arch:      "amd64",
-			Variant:   "",
+			OS:        os,
+			Arch:      arch,
+			Variant:   variant,
 			Kernel:    "",
 			Limit:     0,
 			Started:   stageV0.Started,
@@ -63,41 +86,205 @@ func MigrateStages(source, target *sql.DB) error {
 			OnSuccess: true,
 			OnFailure: false,
 			DependsOn: []string{},
-			Labels:    map[string]string{},
+			Labels:    stageLabels(stageV0.Environ, opts.StageLabels),
 		}
-		if stageV1.Name == "" {
-			stageV1.Name = "default"
+
+		// matrix stages are named after their labels, so that
+		// the stages of a matrix build have distinct names.
+		stageV1.Name = stageName(stageV0.Name, stageV1.Labels)
+		if stageV0.Name == "" && len(stageV1.Labels) == 0 {
+			task.warn(log, "stage name defaulted")
+		}
+		if name := truncateChars(stageV1.Name, 100); name != stageV1.Name {
+			stageV1.Name = name
+			task.warn(log, "stage name truncated")
 		}
 
-		err = meddler.Insert(tx, "stages", stageV1)
-		if err != nil {
-			logrus.WithError(err).Errorln("migration failed")
-			return err
+		if err := task.insert("stages", stageV0.ID, stageV1, log); err != nil {
+			return 0, err
+		}
+		if err := task.progress(stageV0.ID); err != nil {
+			return 0, err
 		}
+		return stageV0.ID, nil
 	}
 
-	if meddler.Default == meddler.PostgreSQL {
-		_, err = tx.Exec(fmt.Sprintf(updateStageSeq, sequence+1))
-		if err != nil {
-			logrus.WithError(err).Errorln("failed to reset sequence")
-			return err
-		}
+	// 3. when the step is synced, migrate the stages that were
+	// running or completed since the previous run, and then
+	// the new stages.
+	if err := task.changed(source, stageChangedQuery, stageChangedCountQuery, migrate); err != nil {
+		return err
+	}
+	err = paginate(source, stageListQuery, task.ledger.LastID, opts.pageSize(), migrate)
+	if err != nil {
+		return err
 	}
 
+	if err := task.resetSequence(updateStageSeq); err != nil {
+		return err
+	}
+
+	logrus.Infof("migrated %d stages", task.report.Inserted)
 	logrus.Infof("migration complete")
-	return tx.Commit()
+	return task.commit()
+}
+
+// Stage kind and type of the migrated stages, which are the
+// defaults of 1.x pipelines.
+const (
+	stageKind = "pipeline"
+	stageType = "docker"
+)
+
+// maxPlatform and maxVariant are the lengths of the os, arch
+// and variant columns of the 1.x stages table.
+const (
+	maxPlatform = 50
+	maxVariant  = 10
+)
+
+// helper function returns the stage labels, which are the
+// matrix variables of the 0.8 stage. If the allow list is not
+// empty, only the listed variables are returned.
+func stageLabels(environ map[string]string, allow []string) map[string]string {
+	allowed := map[string]bool{}
+	for _, key := range allow {
+		allowed[key] = true
+	}
+	labels := map[string]string{}
+	for key, value := range environ {
+		if len(allowed) == 0 || allowed[key] {
+			labels[key] = value
+		}
+	}
+	return labels
+}
+
+// helper function returns the stage name. The name of a stage
+// with labels includes the labels, sorted by key, for example
+// "DATABASE=mysql, GO_VERSION=1.11", or "test (GO_VERSION=1.11)"
+// if the 0.8 stage is named.
+func stageName(name string, labels map[string]string) string {
+	if len(labels) == 0 {
+		if name == "" {
+			return "default"
+		}
+		return name
+	}
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, key := range keys {
+		pairs[i] = key + "=" + labels[key]
+	}
+	axes := strings.Join(pairs, ", ")
+	if name == "" {
+		return axes
+	}
+	return name + " (" + axes + ")"
+}
+
+// helper function parses the 0.8 platform, in the os/arch or
+// os/arch/variant format. The linux/amd64 platform is returned
+// if the platform is empty or malformed, or the os or arch
+// exceed the column length, and ok is false. The variant is
+// returned as is, and must be checked by the caller.
+func parsePlatform(platform string) (os, arch, variant string, ok bool) {
+	parts := strings.SplitN(strings.ToLower(strings.TrimSpace(platform)), "/", 3)
+	if len(parts) < 2 || parts[0] == "" || parts[1] == "" ||
+		len(parts[0]) > maxPlatform || len(parts[1]) > maxPlatform {
+		return "linux", "amd64", "", false
+	}
+	if len(parts) == 3 {
+		variant = parts[2]
+	}
+	return parts[0], parts[1], variant, true
+}
+
+// helper function truncates the string to n characters. Unlike
+// a byte slice, a multi-byte character is never split, which
+// would produce an invalid string.
+func truncateChars(s string, n int) string {
+	i := 0
+	for j := range s {
+		if i == n {
+			return s[:j]
+		}
+		i++
+	}
+	return s
 }
 
 const stageListQuery = `
 SELECT procs.*
+      ,builds.build_repo_id AS proc_repo_id
+      ,(SELECT COUNT(*)
+        FROM procs siblings
+        WHERE siblings.proc_build_id = procs.proc_build_id
+          AND siblings.proc_ppid = 0
+          AND siblings.proc_pid <= procs.proc_pid) AS proc_number
+FROM procs
+INNER JOIN builds ON procs.proc_build_id = builds.build_id
+INNER JOIN repos ON builds.build_repo_id = repos.repo_id
+WHERE proc_ppid = 0
+  AND repo_user_id > 0
+  AND proc_id > %d
+ORDER BY proc_id
+LIMIT %d
+`
+
+const stageCountQuery = `
+SELECT COUNT(*)
+FROM procs
+INNER JOIN builds ON procs.proc_build_id = builds.build_id
+INNER JOIN repos ON builds.build_repo_id = repos.repo_id
+WHERE proc_ppid = 0
+  AND repo_user_id > 0
+  AND proc_id > %d
+`
+
+const stageChangedQuery = `
+SELECT procs.*
+      ,builds.build_repo_id AS proc_repo_id
+      ,(SELECT COUNT(*)
+        FROM procs siblings
+        WHERE siblings.proc_build_id = procs.proc_build_id
+          AND siblings.proc_ppid = 0
+          AND siblings.proc_pid <= procs.proc_pid) AS proc_number
 FROM procs
 INNER JOIN builds ON procs.proc_build_id = builds.build_id
 INNER JOIN repos ON builds.build_repo_id = repos.repo_id
 WHERE proc_ppid = 0
   AND repo_user_id > 0
+  AND proc_id > %%d
+  AND proc_id <= %d
+  AND (proc_stopped = 0 OR proc_stopped > %d)
+ORDER BY proc_id
+LIMIT %%d
+`
+
+const stageChangedCountQuery = `
+SELECT COUNT(*)
+FROM procs
+INNER JOIN builds ON procs.proc_build_id = builds.build_id
+INNER JOIN repos ON builds.build_repo_id = repos.repo_id
+WHERE proc_ppid = 0
+  AND repo_user_id > 0
+  AND proc_id > %%d
+  AND proc_id <= %d
+  AND (proc_stopped = 0 OR proc_stopped > %d)
+`
+
+const procWatermarkQuery = `
+SELECT COALESCE(MAX(proc_stopped), 0)
+FROM procs
 `
 
 const updateStageSeq = `
-ALTER SEQUENCE stages_stage_id_seq
-RESTART WITH %d
+SELECT setval('stages_stage_id_seq', GREATEST(%d
+  ,(SELECT MAX(stage_id) FROM stages)
+  ,(SELECT last_value FROM stages_stage_id_seq)))
 `
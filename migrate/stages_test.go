@@ -0,0 +1,96 @@
+package migrate
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParsePlatform(t *testing.T) {
+	long := strings.Repeat("x", maxPlatform+1)
+	tests := []struct {
+		platform          string
+		os, arch, variant string
+		ok                bool
+	}{
+		{"linux/amd64", "linux", "amd64", "", true},
+		{"linux/arm/v7", "linux", "arm", "v7", true},
+		{" Windows/AMD64 ", "windows", "amd64", "", true},
+		{"linux/arm64/v8/extra", "linux", "arm64", "v8/extra", true},
+		{"", "linux", "amd64", "", false},
+		{"linux", "linux", "amd64", "", false},
+		{"linux/", "linux", "amd64", "", false},
+		{"/amd64", "linux", "amd64", "", false},
+		{long + "/amd64", "linux", "amd64", "", false},
+		{"linux/" + long, "linux", "amd64", "", false},
+	}
+	for _, test := range tests {
+		os, arch, variant, ok := parsePlatform(test.platform)
+		if os != test.os || arch != test.arch || variant != test.variant || ok != test.ok {
+			t.Errorf("%q: want %s, %s, %q, %v, got %s, %s, %q, %v",
+				test.platform, test.os, test.arch, test.variant, test.ok, os, arch, variant, ok)
+		}
+	}
+}
+
+func TestTruncateChars(t *testing.T) {
+	tests := []struct {
+		s    string
+		n    int
+		want string
+	}{
+		{"", 5, ""},
+		{"build", 5, "build"},
+		{"build", 10, "build"},
+		{"build", 3, "bui"},
+		{"build", 0, ""},
+		{"bäuen", 2, "bä"},
+		{"日本語のビルド", 3, "日本語"},
+	}
+	for _, test := range tests {
+		if got := truncateChars(test.s, test.n); got != test.want {
+			t.Errorf("truncate %q to %d: want %q, got %q", test.s, test.n, test.want, got)
+		}
+	}
+}
+
+func TestStageLabels(t *testing.T) {
+	environ := map[string]string{"GO_VERSION": "1.11", "DATABASE": "mysql"}
+	tests := []struct {
+		allow []string
+		want  map[string]string
+	}{
+		{nil, map[string]string{"GO_VERSION": "1.11", "DATABASE": "mysql"}},
+		{[]string{"GO_VERSION"}, map[string]string{"GO_VERSION": "1.11"}},
+		{[]string{"GO_VERSION", "REDIS"}, map[string]string{"GO_VERSION": "1.11"}},
+		{[]string{"REDIS"}, map[string]string{}},
+	}
+	for _, test := range tests {
+		if got := stageLabels(environ, test.allow); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("allow %v: want %v, got %v", test.allow, test.want, got)
+		}
+	}
+	if got := stageLabels(nil, nil); len(got) != 0 {
+		t.Errorf("want no labels, got %v", got)
+	}
+}
+
+func TestStageName(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels map[string]string
+		want   string
+	}{
+		{"", nil, "default"},
+		{"test", nil, "test"},
+		{"test", map[string]string{}, "test"},
+		{"", map[string]string{"GO_VERSION": "1.11"}, "GO_VERSION=1.11"},
+		{"", map[string]string{"GO_VERSION": "1.11", "DATABASE": "mysql"}, "DATABASE=mysql, GO_VERSION=1.11"},
+		{"test", map[string]string{"GO_VERSION": "1.11", "DATABASE": "mysql"}, "test (DATABASE=mysql, GO_VERSION=1.11)"},
+	}
+	for _, test := range tests {
+		if got := stageName(test.name, test.labels); got != test.want {
+			t.Errorf("%q %v: want %q, got %q", test.name, test.labels, test.want, got)
+		}
+	}
+}
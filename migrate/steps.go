@@ -2,51 +2,60 @@ package migrate
 
 import (
 	"database/sql"
-	"fmt"
 
-	"github.com/russross/meddler"
 	"github.com/sirupsen/logrus"
 )
 
 // MigrateSteps migrates the steps from the V0
 // database to the V1 database.
-func MigrateSteps(source, target *sql.DB) error {
-	stepsV0 := []*StepV0{}
-
-	// 1. load all stages from the V0 database.
-	err := meddler.QueryAll(source, &stepsV0, stepListQuery)
+func MigrateSteps(source, target *sql.DB, opts Options) (err error) {
+	task, err := beginTask(target, "migrate-steps", opts)
 	if err != nil {
 		return err
 	}
+	defer func() { task.end(err) }()
 
-	logrus.Infof("migrating %d steps", len(stepsV0))
+	logrus.Infoln("migrating steps")
+	task.count(source, stepCountQuery)
+	if err := task.mark(source, procWatermarkQuery); err != nil {
+		return err
+	}
 
-	// 2. create a database transaction so that we
+	// 1. create a database transaction so that we
 	// can rollback if the data migration fails.
-	tx, err := target.Begin()
-	if err != nil {
+	if err := task.begin(); err != nil {
 		return err
 	}
-	defer tx.Rollback()
-
-	// 3. iterate through the list and convert from
-	// the 0.x to the 1.x structure and insert.
-	var sequence int64
-	for _, stepV0 := range stepsV0 {
-		if stepV0.ID > sequence {
-			sequence = stepV0.ID
+
+	// 2. iterate through the V0 steps one page at a
+	// time, convert from the 0.x to the 1.x structure
+	// and insert.
+	migrate := func(rows *sql.Rows) (int64, error) {
+		stepV0 := &StepV0{}
+		if err := scanRow(rows, stepV0); err != nil {
+			return 0, err
 		}
+		if !task.selected(stepV0.ID) {
+			return stepV0.ID, nil
+		}
+		task.report.Read++
+		task.track(stepV0.ID)
+
+		log := logrus.
+			WithField("build", stepV0.BuildID).
+			WithField("step", stepV0.PID)
+		log.Debugln("migrate step")
 
-		stageV0 := &StageV0{}
-		err := meddler.QueryRow(source, stageV0, fmt.Sprintf("select * from procs where proc_pid = %d and proc_build_id = %d", stepV0.PPID, stepV0.BuildID))
-		if err != nil {
-			logrus.WithError(err).Errorln("cannot find parent step")
-			return err
+		// the parent stage is resolved by the list query.
+		// steps without a parent stage cannot be migrated.
+		if stepV0.ParentID == 0 {
+			task.skip(log, "parent stage not found")
+			return stepV0.ID, task.progress(stepV0.ID)
 		}
 
 		stepV1 := &StepV1{
 			ID:        stepV0.ID,
-			StageID:   stageV0.ID,
+			StageID:   stepV0.ParentID,
 			Number:    stepV0.PID,
 			Name:      stepV0.Name,
 			Status:    stepV0.State,
@@ -58,35 +67,94 @@ func MigrateSteps(source, target *sql.DB) error {
 			Version:   1,
 		}
 
-		err = meddler.Insert(tx, "steps", stepV1)
-		if err != nil {
-			logrus.WithError(err).Errorln("migration failed")
-			return err
+		if err := task.insert("steps", stepV0.ID, stepV1, log); err != nil {
+			return 0, err
 		}
+		if err := task.progress(stepV0.ID); err != nil {
+			return 0, err
+		}
+		return stepV0.ID, nil
 	}
 
-	if meddler.Default == meddler.PostgreSQL {
-		_, err = tx.Exec(fmt.Sprintf(updateStepSeq, sequence+1))
-		if err != nil {
-			logrus.WithError(err).Errorln("failed to reset sequence")
-			return err
-		}
+	// 3. when the step is synced, migrate the steps that were
+	// running or completed since the previous run, and then
+	// the new steps.
+	if err := task.changed(source, stepChangedQuery, stepChangedCountQuery, migrate); err != nil {
+		return err
+	}
+	err = paginate(source, stepListQuery, task.ledger.LastID, opts.pageSize(), migrate)
+	if err != nil {
+		return err
 	}
 
+	if err := task.resetSequence(updateStepSeq); err != nil {
+		return err
+	}
+
+	logrus.Infof("migrated %d steps", task.report.Inserted)
+	if task.report.Skipped != 0 {
+		logrus.Warnf("skipped %d steps without a parent stage", task.report.Skipped)
+	}
 	logrus.Infof("migration complete")
-	return tx.Commit()
+	return task.commit()
 }
 
 const stepListQuery = `
-SELECT procs.*
+SELECT procs.*, COALESCE(parent.proc_id, 0) AS proc_parent_id
+FROM procs
+INNER JOIN builds ON procs.proc_build_id = builds.build_id
+INNER JOIN repos ON builds.build_repo_id = repos.repo_id
+LEFT OUTER JOIN procs parent
+  ON parent.proc_build_id = procs.proc_build_id
+ AND parent.proc_pid = procs.proc_ppid
+WHERE procs.proc_ppid != 0
+  AND repo_user_id > 0
+  AND procs.proc_id > %d
+ORDER BY procs.proc_id
+LIMIT %d
+`
+
+const stepCountQuery = `
+SELECT COUNT(*)
+FROM procs
+INNER JOIN builds ON procs.proc_build_id = builds.build_id
+INNER JOIN repos ON builds.build_repo_id = repos.repo_id
+WHERE procs.proc_ppid != 0
+  AND repo_user_id > 0
+  AND procs.proc_id > %d
+`
+
+const stepChangedQuery = `
+SELECT procs.*, COALESCE(parent.proc_id, 0) AS proc_parent_id
+FROM procs
+INNER JOIN builds ON procs.proc_build_id = builds.build_id
+INNER JOIN repos ON builds.build_repo_id = repos.repo_id
+LEFT OUTER JOIN procs parent
+  ON parent.proc_build_id = procs.proc_build_id
+ AND parent.proc_pid = procs.proc_ppid
+WHERE procs.proc_ppid != 0
+  AND repo_user_id > 0
+  AND procs.proc_id > %%d
+  AND procs.proc_id <= %d
+  AND (procs.proc_stopped = 0 OR procs.proc_stopped > %d)
+ORDER BY procs.proc_id
+LIMIT %%d
+`
+
+const stepChangedCountQuery = `
+SELECT COUNT(*)
 FROM procs
 INNER JOIN builds ON procs.proc_build_id = builds.build_id
 INNER JOIN repos ON builds.build_repo_id = repos.repo_id
-WHERE proc_ppid != 0
+WHERE procs.proc_ppid != 0
   AND repo_user_id > 0
+  AND procs.proc_id > %%d
+  AND procs.proc_id <= %d
+  AND (procs.proc_stopped = 0 OR procs.proc_stopped > %d)
 `
 
 const updateStepSeq = `
-ALTER SEQUENCE steps_step_id_seq
-RESTART WITH %d
+SELECT setval('steps_step_id_seq', GREATEST(%d
+  ,(SELECT MAX(step_id) FROM steps)
+  ,(SELECT last_value FROM steps_step_id_seq)))
 `
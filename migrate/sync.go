@@ -0,0 +1,80 @@
+package migrate
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/russross/meddler"
+)
+
+// Watermark records the highest completion timestamp read
+// from the source database by a migration step, in addition
+// to the highest identifier recorded in the ledger. Rows that
+// complete after the watermark are migrated again when the
+// step is synced, so that builds, stages and steps that were
+// running during the previous run are updated.
+type Watermark struct {
+	Step    string `meddler:"watermark_step"`
+	Value   int64  `meddler:"watermark_value"`
+	Updated int64  `meddler:"watermark_updated"`
+}
+
+// ListWatermarks returns the watermarks of all migration
+// steps, ordered by step.
+func ListWatermarks(target *sql.DB) ([]*Watermark, error) {
+	watermarks := []*Watermark{}
+	err := meddler.QueryAll(target, &watermarks, watermarkListQuery)
+	return watermarks, err
+}
+
+// helper function loads the watermark of the named step. If
+// the step has never recorded a watermark, zero is returned.
+func findWatermark(db meddler.DB, step string) (int64, error) {
+	var value int64
+	err := db.QueryRow(rebind(watermarkFindQuery), step).Scan(&value)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return value, err
+}
+
+// helper function saves the watermark of the named step. This
+// should be executed in the same transaction as the migrated
+// rows, so that the watermark never gets ahead of the target
+// database.
+func saveWatermark(db meddler.DB, step string, value int64) error {
+	if _, err := db.Exec(rebind(watermarkDeleteStmt), step); err != nil {
+		return err
+	}
+	return meddler.Insert(db, "migrate_watermarks", &Watermark{
+		Step:    step,
+		Value:   value,
+		Updated: time.Now().Unix(),
+	})
+}
+
+// helper function reads the current watermark from the source
+// database. The query returns the highest completion timestamp
+// of the source table.
+func readWatermark(source *sql.DB, query string) (int64, error) {
+	var value int64
+	err := source.QueryRow(query).Scan(&value)
+	return value, err
+}
+
+const watermarkListQuery = `
+SELECT *
+FROM migrate_watermarks
+ORDER BY watermark_step
+`
+
+const watermarkFindQuery = `
+SELECT watermark_value
+FROM migrate_watermarks
+WHERE watermark_step = ?
+`
+
+const watermarkDeleteStmt = `
+DELETE FROM migrate_watermarks
+WHERE watermark_step = ?
+`
@@ -0,0 +1,166 @@
+package migrate
+
+import (
+	"database/sql"
+	"testing"
+)
+
+func TestSync(t *testing.T) {
+	source := openSource(t)
+	target := openTarget(t)
+
+	execAll(t, source,
+		`INSERT INTO users (user_id, user_login, user_email) VALUES (1, 'octocat', 'octocat@example.com')`,
+		`INSERT INTO repos (repo_id, repo_user_id, repo_owner, repo_name, repo_full_name, repo_branch, repo_counter)
+		 VALUES (1, 1, 'octocat', 'hello-world', 'octocat/hello-world', 'master', 2)`,
+		// build 1 completed before the first run, and build 2
+		// was running.
+		`INSERT INTO builds (build_id, build_repo_id, build_number, build_status, build_title, build_started, build_finished)
+		 VALUES (1, 1, 1, 'success', 'first', 100, 200)`,
+		`INSERT INTO builds (build_id, build_repo_id, build_number, build_status, build_title, build_started, build_finished)
+		 VALUES (2, 1, 2, 'running', 'second', 300, 0)`,
+		`INSERT INTO procs (proc_id, proc_build_id, proc_pid, proc_ppid, proc_name, proc_state, proc_started, proc_stopped)
+		 VALUES (1, 1, 1, 0, 'default', 'success', 100, 200)`,
+		`INSERT INTO procs (proc_id, proc_build_id, proc_pid, proc_ppid, proc_name, proc_state, proc_started, proc_stopped)
+		 VALUES (2, 1, 2, 1, 'build', 'success', 100, 200)`,
+		`INSERT INTO procs (proc_id, proc_build_id, proc_pid, proc_ppid, proc_name, proc_state, proc_started, proc_stopped)
+		 VALUES (3, 2, 1, 0, 'default', 'running', 300, 0)`,
+		`INSERT INTO procs (proc_id, proc_build_id, proc_pid, proc_ppid, proc_name, proc_state, proc_started, proc_stopped)
+		 VALUES (4, 2, 2, 1, 'build', 'running', 300, 0)`,
+	)
+
+	if err := runSteps(source, target, Options{Report: new(Report)}); err != nil {
+		t.Fatal(err)
+	}
+	assertWatermark(t, target, "migrate-builds", 200)
+	assertWatermark(t, target, "migrate-stages", 200)
+	assertWatermark(t, target, "migrate-steps", 200)
+
+	execAll(t, source,
+		`UPDATE repos SET repo_branch = 'main', repo_counter = 3 WHERE repo_id = 1`,
+		// build 2 completed after the first run, and build 3
+		// was created.
+		`UPDATE builds SET build_status = 'failure', build_finished = 400 WHERE build_id = 2`,
+		`UPDATE procs SET proc_state = 'failure', proc_exit_code = 1, proc_stopped = 400 WHERE proc_build_id = 2`,
+		`INSERT INTO builds (build_id, build_repo_id, build_number, build_status, build_title, build_started, build_finished)
+		 VALUES (3, 1, 3, 'success', 'third', 500, 600)`,
+		`INSERT INTO procs (proc_id, proc_build_id, proc_pid, proc_ppid, proc_name, proc_state, proc_started, proc_stopped)
+		 VALUES (5, 3, 1, 0, 'default', 'success', 500, 600)`,
+		// build 1 completed before the watermark, so it is
+		// not checked for changes.
+		`UPDATE builds SET build_title = 'changed' WHERE build_id = 1`,
+	)
+
+	report := new(Report)
+	if err := runSteps(source, target, Options{Sync: true, Report: report}); err != nil {
+		t.Fatal(err)
+	}
+	assertWatermark(t, target, "migrate-builds", 600)
+	assertWatermark(t, target, "migrate-stages", 600)
+	assertWatermark(t, target, "migrate-steps", 600)
+
+	// the repository is refreshed, keeping the identifier of
+	// the target repository.
+	var uid, branch string
+	var counter int64
+	err := target.QueryRow("SELECT repo_uid, repo_branch, repo_counter FROM repos WHERE repo_id = 1").
+		Scan(&uid, &branch, &counter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uid != "temp_1" || branch != "main" || counter != 3 {
+		t.Errorf("want refreshed repository temp_1, main, 3, got %s, %s, %d", uid, branch, counter)
+	}
+
+	builds := []struct {
+		id       int64
+		status   string
+		title    string
+		finished int64
+	}{
+		{1, "success", "first", 200},
+		{2, "failure", "second", 400},
+		{3, "success", "third", 600},
+	}
+	for _, want := range builds {
+		var status, title string
+		var finished int64
+		err := target.QueryRow("SELECT build_status, build_title, build_finished FROM builds WHERE build_id = ?", want.id).
+			Scan(&status, &title, &finished)
+		if err != nil {
+			t.Fatalf("build %d: %s", want.id, err)
+		}
+		if status != want.status || title != want.title || finished != want.finished {
+			t.Errorf("build %d: want %s, %s, %d, got %s, %s, %d",
+				want.id, want.status, want.title, want.finished, status, title, finished)
+		}
+	}
+
+	procs := []struct {
+		query   string
+		id      int64
+		status  string
+		stopped int64
+	}{
+		{"SELECT stage_status, stage_stopped FROM stages WHERE stage_id = ?", 1, "success", 200},
+		{"SELECT stage_status, stage_stopped FROM stages WHERE stage_id = ?", 3, "failure", 400},
+		{"SELECT stage_status, stage_stopped FROM stages WHERE stage_id = ?", 5, "success", 600},
+		{"SELECT step_status, step_stopped FROM steps WHERE step_id = ?", 2, "success", 200},
+		{"SELECT step_status, step_stopped FROM steps WHERE step_id = ?", 4, "failure", 400},
+	}
+	for _, want := range procs {
+		var status string
+		var stopped int64
+		if err := target.QueryRow(want.query, want.id).Scan(&status, &stopped); err != nil {
+			t.Fatalf("proc %d: %s", want.id, err)
+		}
+		if status != want.status || stopped != want.stopped {
+			t.Errorf("proc %d: want %s, %d, got %s, %d", want.id, want.status, want.stopped, status, stopped)
+		}
+	}
+
+	counts := map[string][2]int64{
+		"migrate-users":  {0, 1},
+		"migrate-repos":  {0, 1},
+		"migrate-builds": {1, 1},
+		"migrate-stages": {1, 1},
+		"migrate-steps":  {0, 1},
+	}
+	for _, step := range report.Steps {
+		want := counts[step.Step]
+		if step.Inserted != want[0] || step.Updated != want[1] {
+			t.Errorf("%s: want %d inserted and %d updated, got %d and %d",
+				step.Step, want[0], want[1], step.Inserted, step.Updated)
+		}
+	}
+}
+
+// helper function runs the migration steps synced by the
+// sync command, excluding logs and secrets.
+func runSteps(source, target *sql.DB, opts Options) error {
+	steps := []func(source, target *sql.DB, opts Options) error{
+		MigrateUsers,
+		MigrateRepos,
+		MigrateBuilds,
+		MigrateStages,
+		MigrateSteps,
+	}
+	for _, step := range steps {
+		if err := step(source, target, opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// helper function asserts the watermark of the step.
+func assertWatermark(t *testing.T, target *sql.DB, step string, want int64) {
+	t.Helper()
+	got, err := findWatermark(target, step)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("%s: want watermark %d, got %d", step, want, got)
+	}
+}
@@ -0,0 +1,386 @@
+package migrate
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/russross/meddler"
+	"github.com/sirupsen/logrus"
+)
+
+// task tracks the execution of a migration step, recording
+// its progress in the ledger and its results in the report.
+type task struct {
+	target *sql.DB
+	tx     *sql.Tx
+	opts   Options
+	ledger *Ledger
+	report *StepReport
+
+	// failures records the rows that fail to insert.
+	failures *failureLog
+
+	// batch is the number of rows committed per transaction,
+	// and pending is the number of rows not yet committed.
+	batch   int
+	pending int
+
+	// synced is the highest source identifier migrated by a
+	// previous run when the step is synced. Rows up to this
+	// identifier are updated rather than inserted.
+	synced int64
+
+	// previous is the watermark recorded by the previous run,
+	// and watermark the watermark recorded when the step is
+	// committed, if marked.
+	previous  int64
+	watermark int64
+	marked    bool
+
+	// sequence is the highest source identifier read by this
+	// run that was not migrated by a previous run.
+	sequence int64
+}
+
+// helper function begins the named migration step. In dry
+// run mode the ledger is loaded but never written. When the
+// step is retried, the ledger is neither loaded nor written,
+// and the rows are inserted in a single transaction.
+func beginTask(target *sql.DB, step string, opts Options) (*task, error) {
+	t := &task{
+		target: target,
+		opts:   opts,
+		report: opts.step(step),
+		batch:  opts.batchSize(step),
+	}
+	t.failures = newFailureLog(step, opts, t.report, ErrorAbort)
+
+	var err error
+	switch {
+	case t.failures.retrying():
+		t.ledger = &Ledger{Step: step, LastID: t.failures.after()}
+		t.batch = 0
+	case opts.DryRun:
+		t.ledger, err = findLedger(target, step)
+	default:
+		t.ledger, err = beginLedger(target, step)
+	}
+	if err == nil && opts.Sync && !t.failures.retrying() {
+		t.synced = t.ledger.LastID
+	}
+	return t, err
+}
+
+// helper function returns the identifier after which the
+// source rows are read. When the step is synced, all rows are
+// read, so that the rows migrated by a previous run are
+// updated.
+func (t *task) after() int64 {
+	if t.synced > 0 {
+		return 0
+	}
+	return t.ledger.LastID
+}
+
+// helper function returns true if the row with the source
+// identifier was migrated by a previous run of the synced
+// step.
+func (t *task) refreshed(id int64) bool {
+	return id <= t.synced
+}
+
+// helper function loads the watermark recorded by the previous
+// run, and reads the current watermark from the source
+// database, which is recorded when the step is committed. The
+// current watermark is read before the rows, so that rows
+// completed while the step runs are synced by the next run.
+// The watermark is not advanced when a previous run is resumed
+// without syncing, since the rows of the previous run are not
+// checked for changes.
+func (t *task) mark(source *sql.DB, query string) error {
+	if t.failures.retrying() {
+		return nil
+	}
+	var err error
+	t.previous, err = findWatermark(t.target, t.ledger.Step)
+	if err != nil {
+		return err
+	}
+	t.marked = true
+	if t.ledger.LastID > 0 && !t.opts.Sync {
+		t.watermark = t.previous
+		return nil
+	}
+	t.watermark, err = readWatermark(source, query)
+	return err
+}
+
+// helper function migrates the rows that were migrated by a
+// previous run and changed since, when the step is synced. The
+// query is formatted with the highest migrated identifier and
+// the previous watermark, and then paginated like the import
+// query. The count query is formatted the same way.
+func (t *task) changed(source *sql.DB, query, countQuery string, scan func(rows *sql.Rows) (int64, error)) error {
+	if t.synced == 0 {
+		return nil
+	}
+	logrus.WithField("step", t.ledger.Step).
+		Infof("syncing rows changed after watermark %d", t.previous)
+	rows := countRows(source, fmt.Sprintf(countQuery, t.synced, t.previous), 0)
+	t.report.expect(t.report.expected + rows)
+	return paginate(source, fmt.Sprintf(query, t.synced, t.previous), 0, t.opts.pageSize(), scan)
+}
+
+// helper function returns true if the row with the source
+// identifier should be migrated. When the step is retried,
+// only the rows being retried are migrated.
+func (t *task) selected(id int64) bool {
+	return t.failures.selected(id)
+}
+
+// helper function begins the database transaction into which
+// rows are inserted.
+func (t *task) begin() error {
+	tx, err := t.target.Begin()
+	if err != nil {
+		return err
+	}
+	t.tx = tx
+	return nil
+}
+
+// helper function records the number of rows the step is
+// expected to process.
+func (t *task) expect(rows int64) {
+	t.report.expect(t.failures.expected(rows))
+}
+
+// helper function counts the source rows after the last
+// migrated row, and records them as the rows the step is
+// expected to process.
+func (t *task) count(source *sql.DB, query string) {
+	if t.failures.retrying() {
+		t.expect(0)
+		return
+	}
+	t.expect(countRows(source, query, t.ledger.LastID))
+}
+
+// helper function inserts the row with the source identifier
+// into the target database. A row that fails to insert is
+// recorded in the failure ledger, and aborts the step unless
+// the error policy skips or quarantines the row. In dry run
+// mode a failed insert is reported as a conflict instead. A
+// row that is not inserted because of the conflict policy is
+// also reported as a conflict.
+func (t *task) insert(table string, id int64, src interface{}, log *logrus.Entry) error {
+	return t.write(id, log, func(tx *sql.Tx) (bool, error) {
+		return insertRow(tx, table, src, t.opts.conflictPolicy())
+	})
+}
+
+// helper function executes the update statement for the row
+// with the source identifier. A row that fails to update is
+// handled like a row that fails to insert.
+func (t *task) update(id int64, log *logrus.Entry, stmt string, args ...interface{}) error {
+	return t.write(id, log, func(tx *sql.Tx) (bool, error) {
+		_, err := tx.Exec(rebind(stmt), args...)
+		return true, err
+	})
+}
+
+// helper function writes the row with the source identifier
+// to the target database, recording a failed write in the
+// failure ledger.
+func (t *task) write(id int64, log *logrus.Entry, write func(tx *sql.Tx) (bool, error)) error {
+	tx := t.tx
+	if !t.opts.DryRun && t.failures.policy == ErrorAbort {
+		inserted, err := write(tx)
+		if err != nil {
+			return t.failures.fail(id, "migration failed", err, log)
+		}
+		t.inserted(id, inserted, log)
+		return nil
+	}
+
+	// the insert is wrapped in a savepoint, so that the
+	// transaction can continue after a failed insert.
+	if _, err := tx.Exec("SAVEPOINT migrate_row"); err != nil {
+		return err
+	}
+	inserted, err := write(tx)
+	if err != nil {
+		if _, err := tx.Exec("ROLLBACK TO SAVEPOINT migrate_row"); err != nil {
+			return err
+		}
+		if t.opts.DryRun {
+			log.WithError(err).Warnln("dry run: insert conflict")
+			t.report.Conflicts++
+			return nil
+		}
+		return t.failures.fail(id, "migration failed", err, log)
+	}
+	t.inserted(id, inserted, log)
+	_, err = tx.Exec("RELEASE SAVEPOINT migrate_row")
+	return err
+}
+
+// helper function records the result of an insert. When the
+// step is retried, the row is removed from the failure ledger.
+// When the step is synced, rows migrated by a previous run are
+// reported as updated.
+func (t *task) inserted(id int64, inserted bool, log *logrus.Entry) {
+	if t.failures.retrying() {
+		t.failures.resolve(id)
+	}
+	if !inserted {
+		log.Debugln("skip row, conflicts with existing row")
+		t.report.Conflicts++
+		return
+	}
+	if t.refreshed(id) {
+		t.report.Updated++
+		return
+	}
+	t.report.Inserted++
+	if !t.opts.DryRun {
+		t.ledger.Rows++
+	}
+}
+
+// helper function executes the statement in the task
+// transaction. The statement is rebound to the target
+// database dialect.
+func (t *task) exec(stmt string, args ...interface{}) error {
+	_, err := t.tx.Exec(rebind(stmt), args...)
+	return err
+}
+
+// helper function records the source identifier of a row
+// that has been processed, so that the step can be resumed
+// after this row. The transaction is committed, and a new
+// transaction started, once the batch size is reached.
+func (t *task) progress(id int64) error {
+	t.report.advance()
+	if id > t.ledger.LastID {
+		t.ledger.LastID = id
+	}
+	t.pending++
+	if t.batch <= 0 || t.pending < t.batch || t.opts.DryRun {
+		return nil
+	}
+	if err := t.failures.flush(t.tx); err != nil {
+		return err
+	}
+	if err := saveLedger(t.tx, t.ledger); err != nil {
+		return err
+	}
+	if err := t.tx.Commit(); err != nil {
+		return err
+	}
+	logrus.WithField("step", t.ledger.Step).
+		Debugf("committed batch of %d rows, last id %d", t.pending, t.ledger.LastID)
+	t.pending = 0
+	return t.begin()
+}
+
+// helper function records the source identifier of a row
+// read by the step. The rows migrated by a previous run of a
+// synced step are ignored, so that a sync that only updates
+// rows does not restart the sequence.
+func (t *task) track(id int64) {
+	if id > t.sequence && !t.refreshed(id) {
+		t.sequence = id
+	}
+}
+
+// helper function restarts the postgres sequence after the
+// highest migrated identifier. The statement never moves the
+// sequence backwards, or below the highest identifier of the
+// target table, since the 1.x server may have inserted rows.
+// The sequence is not restarted when the step is retried,
+// since the retried rows are not the highest migrated
+// identifiers.
+func (t *task) resetSequence(stmt string) error {
+	if meddler.Default != meddler.PostgreSQL || t.sequence == 0 || t.opts.DryRun || t.failures.retrying() {
+		return nil
+	}
+	_, err := t.tx.Exec(fmt.Sprintf(stmt, t.sequence))
+	if err != nil {
+		logrus.WithError(err).Errorln("failed to reset sequence")
+	}
+	return err
+}
+
+// helper function records a row that is not migrated.
+func (t *task) skip(log *logrus.Entry, reason string) {
+	t.report.Skipped++
+	t.report.Warnings[reason]++
+	log.Warnln(reason)
+}
+
+// helper function records a lossy or defaulted conversion.
+func (t *task) warn(log *logrus.Entry, warning string) {
+	t.report.Warnings[warning]++
+	if t.opts.DryRun {
+		log.Warnln(warning)
+	} else {
+		log.Debugln(warning)
+	}
+}
+
+// helper function records the step as successful and commits
+// the transaction. In dry run mode the transaction is rolled
+// back instead.
+func (t *task) commit() error {
+	if t.opts.DryRun {
+		logrus.WithField("step", t.ledger.Step).
+			Infoln("dry run: rolling back transaction")
+		return t.tx.Rollback()
+	}
+	if err := t.failures.flush(t.tx); err != nil {
+		return err
+	}
+	if !t.failures.retrying() {
+		if err := finishLedger(t.tx, t.ledger); err != nil {
+			return err
+		}
+	}
+	if t.marked {
+		if err := saveWatermark(t.tx, t.ledger.Step, t.watermark); err != nil {
+			return err
+		}
+	}
+	return t.tx.Commit()
+}
+
+// helper function rolls back the uncommitted rows and records
+// the step as failed if err is not nil. Rows committed in
+// previous batches are kept, and the step resumes after them.
+func (t *task) end(err error) {
+	if t.tx != nil {
+		t.tx.Rollback()
+	}
+	switch {
+	case err == nil:
+	case t.failures.aborted:
+		// the step is aborted by a row that cannot be
+		// migrated, which is recorded in the failure ledger
+		// after the transaction is rolled back.
+		if ferr := t.failures.flush(t.target); ferr != nil {
+			logrus.WithError(ferr).
+				WithField("step", t.ledger.Step).
+				Errorln("cannot update failure ledger")
+		}
+	default:
+		// rows skipped in the rolled back transaction are
+		// migrated again when the step is resumed.
+		t.failures.discard()
+		t.report.fail(err.Error())
+	}
+	t.report.finish()
+	if t.opts.DryRun || t.failures.retrying() {
+		return
+	}
+	failLedger(t.target, t.ledger, err)
+}
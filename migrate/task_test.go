@@ -0,0 +1,91 @@
+package migrate
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/russross/meddler"
+)
+
+func TestResetSequence(t *testing.T) {
+	target := openTarget(t)
+
+	// the statement records the value to which the sequence
+	// is restarted, in place of the postgres statement.
+	const stmt = "INSERT INTO restarts (value) VALUES (%d)"
+	if _, err := target.Exec("CREATE TABLE restarts (value INTEGER)"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a previous run migrated the builds up to id 10.
+	ledger, err := beginLedger(target, "migrate-builds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ledger.LastID = 10
+	if err := finishLedger(target, ledger); err != nil {
+		t.Fatal(err)
+	}
+
+	task, err := beginTask(target, "migrate-builds", Options{Sync: true, Report: new(Report)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := task.begin(); err != nil {
+		t.Fatal(err)
+	}
+	defer task.tx.Rollback()
+
+	meddler.Default = meddler.PostgreSQL
+	defer func() { meddler.Default = meddler.SQLite }()
+
+	// a sync that only updates the rows of the previous run
+	// does not restart the sequence below the migrated rows.
+	task.track(4)
+	task.track(10)
+	if err := task.resetSequence(stmt); err != nil {
+		t.Fatal(err)
+	}
+	if got := restarts(t, task); len(got) != 0 {
+		t.Errorf("want sequence not restarted by updated rows, got %v", got)
+	}
+
+	task.track(12)
+	task.track(11)
+	task.track(7)
+	if err := task.resetSequence(stmt); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := restarts(t, task), []int64{12}; !reflect.DeepEqual(got, want) {
+		t.Errorf("want sequence restarted after %v, got %v", want, got)
+	}
+
+	// the sequence is not restarted in dry run mode.
+	task.opts.DryRun = true
+	if err := task.resetSequence(stmt); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := restarts(t, task), []int64{12}; !reflect.DeepEqual(got, want) {
+		t.Errorf("want sequence not restarted in dry run mode, got %v", got)
+	}
+}
+
+// helper function returns the values to which the sequence
+// was restarted.
+func restarts(t *testing.T, task *task) []int64 {
+	t.Helper()
+	rows, err := task.tx.Query("SELECT value FROM restarts ORDER BY rowid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var values []int64
+	for rows.Next() {
+		var value int64
+		if err := rows.Scan(&value); err != nil {
+			t.Fatal(err)
+		}
+		values = append(values, value)
+	}
+	return values
+}
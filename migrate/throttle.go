@@ -0,0 +1,304 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maxBackoff is the longest pause before a source query when
+// the source database is backing off.
+const maxBackoff = 30 * time.Second
+
+// Throttle limits the rate at which the V0 database is read,
+// so that the migration can run against a live V0 database.
+// The limits apply to all connections of the source database.
+type Throttle struct {
+	// RowsPerSecond limits the number of rows read per
+	// second. If zero, rows are not limited.
+	RowsPerSecond float64
+
+	// QueriesPerSecond limits the number of queries executed
+	// per second. If zero, queries are not limited.
+	QueriesPerSecond float64
+
+	// MaxLatency is the query latency above which the reads
+	// back off. Each slow query doubles the pause before the
+	// next query, and each fast query halves it. If zero,
+	// reads do not back off.
+	MaxLatency time.Duration
+}
+
+// OpenSource opens the V0 database. If the throttle of the
+// options is configured, all reads are throttled.
+func OpenSource(driverName, datasource string, opts Options) (*sql.DB, error) {
+	db, err := sql.Open(driverName, datasource)
+	if err != nil || !opts.Throttle.enabled() {
+		return db, err
+	}
+	connector := &dsnConnector{driver: db.Driver(), datasource: datasource}
+	db.Close()
+	return sql.OpenDB(opts.Throttle.connector(connector)), nil
+}
+
+// helper function returns true if any limit is configured.
+func (t Throttle) enabled() bool {
+	return t.RowsPerSecond > 0 || t.QueriesPerSecond > 0 || t.MaxLatency > 0
+}
+
+// helper function returns a connector that throttles the
+// connections of the base connector. If no limit is
+// configured, the base connector is returned.
+func (t Throttle) connector(base driver.Connector) driver.Connector {
+	if !t.enabled() {
+		return base
+	}
+	logrus.WithFields(logrus.Fields{
+		"rows_per_second":    t.RowsPerSecond,
+		"queries_per_second": t.QueriesPerSecond,
+		"max_latency":        t.MaxLatency,
+	}).Debugln("throttling source database reads")
+	return &throttledConnector{
+		base: base,
+		throttle: &throttle{
+			maxLatency: t.MaxLatency,
+			rows:       limiter{rate: t.RowsPerSecond},
+			queries:    limiter{rate: t.QueriesPerSecond},
+		},
+	}
+}
+
+// throttle is the state of a throttle, shared by all
+// connections of the source database.
+type throttle struct {
+	maxLatency time.Duration
+	rows       limiter
+	queries    limiter
+
+	sync.Mutex
+	pause time.Duration
+}
+
+// helper function waits before a query is executed.
+func (t *throttle) before() {
+	t.Lock()
+	pause := t.pause
+	t.Unlock()
+	throttled(t.queries.wait() + pause)
+}
+
+// helper function records the latency of a query, and
+// adjusts the pause before the next query.
+func (t *throttle) after(latency time.Duration) {
+	if t.maxLatency <= 0 {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+	switch {
+	case latency > t.maxLatency:
+		if t.pause == 0 {
+			t.pause = latency
+		} else {
+			t.pause *= 2
+		}
+		if t.pause > maxBackoff {
+			t.pause = maxBackoff
+		}
+		logrus.WithField("latency", latency).
+			Debugf("source query latency exceeds %s, backing off %s", t.maxLatency, t.pause)
+	case t.pause > 0:
+		t.pause /= 2
+		if t.pause < time.Millisecond {
+			t.pause = 0
+		}
+	}
+}
+
+// helper function waits before a row is read.
+func (t *throttle) row() {
+	throttled(t.rows.wait())
+}
+
+// helper function sleeps for the duration, and records the
+// time spent throttled.
+func throttled(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	atomic.AddInt64(&metrics.throttled, int64(d))
+	time.Sleep(d)
+}
+
+// limiter spaces events evenly at a rate per second.
+type limiter struct {
+	rate float64
+
+	sync.Mutex
+	next time.Time
+}
+
+// helper function reserves the next event, and returns the
+// time to wait until the event is allowed.
+func (l *limiter) wait() time.Duration {
+	if l.rate <= 0 {
+		return 0
+	}
+	l.Lock()
+	defer l.Unlock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	d := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(float64(time.Second) / l.rate))
+	return d
+}
+
+// dsnConnector opens connections with the driver and data
+// source name, like sql.Open.
+type dsnConnector struct {
+	driver     driver.Driver
+	datasource string
+}
+
+func (c *dsnConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.datasource)
+}
+
+func (c *dsnConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// throttledConnector opens connections whose queries are
+// throttled.
+type throttledConnector struct {
+	base     driver.Connector
+	throttle *throttle
+}
+
+func (c *throttledConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.base.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &throttledConn{Conn: conn, throttle: c.throttle}, nil
+}
+
+func (c *throttledConnector) Driver() driver.Driver {
+	return c.base.Driver()
+}
+
+// throttledConn throttles the queries of the connection. The
+// query is executed by a prepared statement if the driver
+// connection does not execute queries directly.
+type throttledConn struct {
+	driver.Conn
+	throttle *throttle
+}
+
+func (c *throttledConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	c.throttle.before()
+	start := time.Now()
+	rows, err := queryer.QueryContext(ctx, query, args)
+	if err != nil {
+		return nil, err
+	}
+	c.throttle.after(time.Since(start))
+	return &throttledRows{Rows: rows, throttle: c.throttle}, nil
+}
+
+func (c *throttledConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	return execer.ExecContext(ctx, query, args)
+}
+
+func (c *throttledConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	var stmt driver.Stmt
+	var err error
+	if preparer, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		stmt, err = preparer.PrepareContext(ctx, query)
+	} else {
+		stmt, err = c.Conn.Prepare(query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &throttledStmt{Stmt: stmt, throttle: c.throttle}, nil
+}
+
+func (c *throttledConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if beginner, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return beginner.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+func (c *throttledConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if checker, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+func (c *throttledConn) ResetSession(ctx context.Context) error {
+	if resetter, ok := c.Conn.(driver.SessionResetter); ok {
+		return resetter.ResetSession(ctx)
+	}
+	return nil
+}
+
+// throttledStmt throttles the queries of the prepared
+// statement.
+type throttledStmt struct {
+	driver.Stmt
+	throttle *throttle
+}
+
+func (s *throttledStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	s.throttle.before()
+	start := time.Now()
+	var rows driver.Rows
+	var err error
+	if queryer, ok := s.Stmt.(driver.StmtQueryContext); ok {
+		rows, err = queryer.QueryContext(ctx, args)
+	} else {
+		values := make([]driver.Value, len(args))
+		for i, arg := range args {
+			values[i] = arg.Value
+		}
+		rows, err = s.Stmt.Query(values)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.throttle.after(time.Since(start))
+	return &throttledRows{Rows: rows, throttle: s.throttle}, nil
+}
+
+// throttledRows throttles the rows read from the result set.
+type throttledRows struct {
+	driver.Rows
+	throttle *throttle
+}
+
+func (r *throttledRows) Next(dest []driver.Value) error {
+	err := r.Rows.Next(dest)
+	if err != io.EOF {
+		r.throttle.row()
+	}
+	return err
+}
@@ -0,0 +1,75 @@
+package migrate
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	l := &limiter{}
+	for i := 0; i < 3; i++ {
+		if d := l.wait(); d != 0 {
+			t.Errorf("want unlimited event without wait, got %s", d)
+		}
+	}
+
+	// events are reserved without waiting, so each event
+	// waits one interval longer than the previous event.
+	l = &limiter{rate: 10}
+	for i := 0; i < 5; i++ {
+		want := time.Duration(i) * 100 * time.Millisecond
+		if d := l.wait(); d < want-10*time.Millisecond || d > want {
+			t.Errorf("event %d: want wait %s, got %s", i, want, d)
+		}
+	}
+
+	// the limiter does not accumulate events while idle.
+	l = &limiter{rate: 100}
+	l.wait()
+	time.Sleep(50 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		want := time.Duration(i) * 10 * time.Millisecond
+		if d := l.wait(); d < want-5*time.Millisecond || d > want {
+			t.Errorf("event %d after idle: want wait %s, got %s", i, want, d)
+		}
+	}
+}
+
+func TestThrottleBackoff(t *testing.T) {
+	th := &throttle{maxLatency: time.Second}
+
+	tests := []struct {
+		latency time.Duration
+		pause   time.Duration
+	}{
+		{500 * time.Millisecond, 0},
+		{2 * time.Second, 2 * time.Second},
+		{2 * time.Second, 4 * time.Second},
+		{5 * time.Second, 8 * time.Second},
+		{time.Second, 4 * time.Second},
+		{10 * time.Second, 8 * time.Second},
+		{10 * time.Second, 16 * time.Second},
+		{10 * time.Second, maxBackoff},
+	}
+	for i, test := range tests {
+		th.after(test.latency)
+		if th.pause != test.pause {
+			t.Errorf("query %d with latency %s: want pause %s, got %s", i, test.latency, test.pause, th.pause)
+		}
+	}
+
+	// fast queries halve the pause until it is cleared.
+	for th.pause != 0 {
+		prev := th.pause
+		th.after(time.Millisecond)
+		if th.pause != 0 && th.pause != prev/2 {
+			t.Fatalf("want pause %s halved, got %s", prev, th.pause)
+		}
+	}
+
+	th = &throttle{}
+	th.after(time.Hour)
+	if th.pause != 0 {
+		t.Errorf("want no backoff without max latency, got pause %s", th.pause)
+	}
+}
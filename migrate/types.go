@@ -186,6 +186,13 @@ type (
 		Machine  string            `meddler:"proc_machine"`
 		Platform string            `meddler:"proc_platform"`
 		Environ  map[string]string `meddler:"proc_environ,json"`
+
+		// RepoID is the repository of the build, and Number is
+		// the position of the stage within the build. These are
+		// not columns of the procs table, and are only set by
+		// queries that join the build and count the stages.
+		RepoID int64 `meddler:"proc_repo_id"`
+		Number int   `meddler:"proc_number"`
 	}
 
 	// StageV1 is a Drone 1.x stage.
@@ -234,6 +241,11 @@ type (
 		Machine  string            `meddler:"proc_machine"`
 		Platform string            `meddler:"proc_platform"`
 		Environ  map[string]string `meddler:"proc_environ,json"`
+
+		// ParentID is the identifier of the parent proc. This
+		// is not a column of the procs table, and is only set
+		// by queries that join the parent proc.
+		ParentID int64 `meddler:"proc_parent_id"`
 	}
 
 	// StepV1 is a Drone 1.x step.
@@ -264,6 +276,22 @@ type (
 		Data []byte `meddler:"log_data"`
 	}
 
+	// LineV0 is a Drone 0.x log line.
+	LineV0 struct {
+		Proc string `json:"proc,omitempty"`
+		Time int64  `json:"time,omitempty"`
+		Type int    `json:"type,omitempty"`
+		Pos  int    `json:"pos,omitempty"`
+		Out  string `json:"out,omitempty"`
+	}
+
+	// LineV1 is a Drone 1.x log line.
+	LineV1 struct {
+		Number    int    `json:"pos"`
+		Message   string `json:"out"`
+		Timestamp int64  `json:"time"`
+	}
+
 	// SecretV0 is a Drone 0.x secret.
 	SecretV0 struct {
 		ID         int64    `meddler:"secret_id"`
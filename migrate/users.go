@@ -15,34 +15,60 @@ import (
 
 // MigrateUsers migrates the user accounts from the V0
 // database to the V1 database.
-func MigrateUsers(source, target *sql.DB) error {
+func MigrateUsers(source, target *sql.DB, opts Options) (err error) {
+	task, err := beginTask(target, "migrate-users", opts)
+	if err != nil {
+		return err
+	}
+	defer func() { task.end(err) }()
+
 	usersV0 := []*UserV0{}
 
-	if err := meddler.QueryAll(source, &usersV0, userImportQuery); err != nil {
+	if err := meddler.QueryAll(source, &usersV0, fmt.Sprintf(userImportQuery, task.after())); err != nil {
 		return err
 	}
 
 	logrus.Infof("migrating %d users", len(usersV0))
+	task.expect(int64(len(usersV0)))
 
-	tx, err := target.Begin()
-
-	if err != nil {
+	if err := task.begin(); err != nil {
 		return err
 	}
 
-	defer tx.Rollback()
-
-	var sequence int64
 	for _, userV0 := range usersV0 {
-		if userV0.ID > sequence {
-			sequence = userV0.ID
+		if !task.selected(userV0.ID) {
+			continue
 		}
+		task.report.Read++
+		task.track(userV0.ID)
 
 		log := logrus.WithFields(logrus.Fields{
 			"id":    userV0.ID,
 			"login": userV0.Login,
 		})
 
+		// when the step is synced, the users migrated by a
+		// previous run are refreshed, keeping the token hash
+		// and timestamps of the target user.
+		if task.refreshed(userV0.ID) {
+			log.Debugln("refresh user")
+			if err := task.update(userV0.ID, log, userRefreshStmt,
+				userV0.Email,
+				userV0.Avatar,
+				userV0.Token,
+				userV0.Secret,
+				userV0.Expiry,
+				time.Now().Unix(),
+				userV0.ID,
+			); err != nil {
+				return err
+			}
+			if err := task.progress(userV0.ID); err != nil {
+				return err
+			}
+			continue
+		}
+
 		log.Debugln("migrate user")
 
 		userV1 := &UserV1{
@@ -64,24 +90,22 @@ func MigrateUsers(source, target *sql.DB) error {
 			Hash:      uniuri.NewLen(32),
 		}
 
-		if err := meddler.Insert(tx, "users", userV1); err != nil {
-			log.WithError(err).Errorln("migration failed")
+		if err := task.insert("users", userV0.ID, userV1, log); err != nil {
+			return err
+		}
+		if err := task.progress(userV0.ID); err != nil {
 			return err
 		}
 
 		log.Debugln("migration complete")
 	}
 
-	if meddler.Default == meddler.PostgreSQL {
-		_, err = tx.Exec(fmt.Sprintf(updateUserSeq, sequence+1))
-		if err != nil {
-			logrus.WithError(err).Errorln("failed to reset sequence")
-			return err
-		}
+	if err := task.resetSequence(updateUserSeq); err != nil {
+		return err
 	}
 
 	logrus.Infoln("migration complete")
-	return tx.Commit()
+	return task.commit()
 }
 
 // DumpTokens dumps the database tokens from the V0
@@ -89,7 +113,7 @@ func MigrateUsers(source, target *sql.DB) error {
 func DumpTokens(source *sql.DB, w io.Writer) error {
 	usersV0 := []*UserV0{}
 
-	if err := meddler.QueryAll(source, &usersV0, userImportQuery); err != nil {
+	if err := meddler.QueryAll(source, &usersV0, fmt.Sprintf(userImportQuery, 0)); err != nil {
 		return err
 	}
 
@@ -108,9 +132,26 @@ SELECT
 	*
 FROM
 	users
+WHERE
+	user_id > %d
+ORDER BY
+	user_id
+`
+
+const userRefreshStmt = `
+UPDATE users
+SET
+ user_email = ?
+,user_avatar = ?
+,user_oauth_token = ?
+,user_oauth_refresh = ?
+,user_oauth_expiry = ?
+,user_updated = ?
+WHERE user_id = ?
 `
 
 const updateUserSeq = `
-ALTER SEQUENCE users_user_id_seq
-RESTART WITH %d
+SELECT setval('users_user_id_seq', GREATEST(%d
+  ,(SELECT MAX(user_id) FROM users)
+  ,(SELECT last_value FROM users_user_id_seq)))
 `
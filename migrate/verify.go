@@ -0,0 +1,520 @@
+package migrate
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Difference kinds.
+const (
+	// DifferenceMissing is a V0 row that does not exist in
+	// the V1 database.
+	DifferenceMissing = "missing"
+
+	// DifferenceExtra is a V1 row that does not exist in the
+	// V0 database.
+	DifferenceExtra = "extra"
+
+	// DifferenceDivergent is a V1 row with values that differ
+	// from the converted V0 row.
+	DifferenceDivergent = "divergent"
+)
+
+// Verification describes the result of comparing the V0
+// database with the V1 database.
+type Verification struct {
+	Entities    []*EntitySummary `json:"entities"`
+	Differences []*Difference    `json:"differences"`
+}
+
+// EntitySummary summarizes the comparison of an entity.
+type EntitySummary struct {
+	Entity    string `json:"entity"`
+	Source    int64  `json:"source"`
+	Target    int64  `json:"target"`
+	Missing   int64  `json:"missing"`
+	Extra     int64  `json:"extra"`
+	Divergent int64  `json:"divergent"`
+}
+
+// Difference describes a row that differs between the V0
+// database and the V1 database.
+type Difference struct {
+	Entity string   `json:"entity"`
+	ID     int64    `json:"id"`
+	Kind   string   `json:"kind"`
+	Fields []string `json:"fields,omitempty"`
+	Source string   `json:"source_checksum,omitempty"`
+	Target string   `json:"target_checksum,omitempty"`
+}
+
+// verifyRow is the identifier and compared values of a row.
+type verifyRow struct {
+	id     int64
+	values []interface{}
+}
+
+// verifyEntity defines the V0 and V1 queries of an entity,
+// and the functions that scan the compared values of a row.
+// The V0 values are converted the same way the migration
+// converts them, using the migration options, and both
+// queries are ordered by identifier.
+type verifyEntity struct {
+	name   string
+	fields []string
+	source string
+	target string
+	from   func(*sql.Rows, Options) (*verifyRow, error)
+	to     func(*sql.Rows) (*verifyRow, error)
+}
+
+// verifyEntities lists the compared entities in migration
+// order. Values that are generated during the migration, or
+// updated by a later step, such as the repository identifier
+// and the secret data, are not compared.
+var verifyEntities = []verifyEntity{
+	{
+		name:   "users",
+		fields: []string{"login", "email", "avatar", "token", "refresh", "expiry"},
+		source: verifyUserQuery,
+		target: verifyUserQuery,
+		from: func(rows *sql.Rows, opts Options) (*verifyRow, error) {
+			v := &UserV0{}
+			err := scanRow(rows, v)
+			return &verifyRow{v.ID, []interface{}{v.Login, v.Email, v.Avatar, v.Token, v.Secret, v.Expiry}}, err
+		},
+		to: func(rows *sql.Rows) (*verifyRow, error) {
+			v := &UserV1{}
+			err := scanRow(rows, v)
+			return &verifyRow{v.ID, []interface{}{v.Login, v.Email, v.Avatar, v.Token, v.Refresh, v.Expiry}}, err
+		},
+	},
+	{
+		name:   "repos",
+		fields: []string{"user_id", "namespace", "name", "slug", "clone_url", "html_url", "branch", "private", "visibility", "config", "trusted", "protected", "timeout"},
+		source: verifyRepoSourceQuery,
+		target: verifyRepoTargetQuery,
+		from: func(rows *sql.Rows, opts Options) (*verifyRow, error) {
+			v := &RepoV0{}
+			err := scanRow(rows, v)
+			return &verifyRow{v.ID, []interface{}{v.UserID, v.Owner, v.Name, v.FullName, v.Clone, v.Link, v.Branch, v.IsPrivate, v.Visibility, v.Config, v.IsTrusted, v.IsGated, v.Timeout}}, err
+		},
+		to: func(rows *sql.Rows) (*verifyRow, error) {
+			v := &RepoV1{}
+			err := scanRow(rows, v)
+			return &verifyRow{v.ID, []interface{}{v.UserID, v.Namespace, v.Name, v.Slug, v.HTTPURL, v.Link, v.Branch, v.Private, v.Visibility, v.Config, v.Trusted, v.Protected, v.Timeout}}, err
+		},
+	},
+	{
+		name:   "secrets",
+		fields: []string{"repo_id", "name", "pull_request"},
+		source: verifySecretSourceQuery,
+		target: verifySecretTargetQuery,
+		from: func(rows *sql.Rows, opts Options) (*verifyRow, error) {
+			v := &SecretV0{}
+			err := scanRow(rows, v)
+			pullRequest := false
+			for _, event := range v.Events {
+				if event == "pull_request" {
+					pullRequest = true
+				}
+			}
+			return &verifyRow{v.ID, []interface{}{v.RepoID, v.Name, pullRequest}}, err
+		},
+		to: func(rows *sql.Rows) (*verifyRow, error) {
+			v := &SecretV1{}
+			err := scanRow(rows, v)
+			return &verifyRow{v.ID, []interface{}{v.RepoID, v.Name, v.PullRequest}}, err
+		},
+	},
+	{
+		// registries are merged into a single secret per
+		// repository, identified by the repository id.
+		name:   "registries",
+		fields: []string{},
+		source: verifyRegistrySourceQuery,
+		target: verifyRegistryTargetQuery,
+		from: func(rows *sql.Rows, opts Options) (*verifyRow, error) {
+			return scanVerifyID(rows)
+		},
+		to: scanVerifyID,
+	},
+	{
+		name:   "builds",
+		fields: []string{"repo_id", "number", "parent", "status", "error", "event", "link", "timestamp", "title", "message", "after", "ref", "target", "author", "author_email", "author_avatar", "sender", "deploy", "started", "finished", "created"},
+		source: verifyBuildQuery,
+		target: verifyBuildQuery,
+		from: func(rows *sql.Rows, opts Options) (*verifyRow, error) {
+			v := &BuildV0{}
+			err := scanRow(rows, v)
+			return &verifyRow{v.ID, []interface{}{v.RepoID, v.Number, v.Parent, v.Status, v.Error, v.Event, v.Link, v.Timestamp, truncate(v.Title, 1000), truncate(v.Message, 1000), v.Commit, v.Ref, v.Branch, v.Author, v.Email, v.Avatar, v.Sender, v.Deploy, v.Started, v.Finished, v.Created}}, err
+		},
+		to: func(rows *sql.Rows) (*verifyRow, error) {
+			v := &BuildV1{}
+			err := scanRow(rows, v)
+			return &verifyRow{v.ID, []interface{}{v.RepoID, v.Number, v.Parent, v.Status, v.Error, v.Event, v.Link, v.Timestamp, v.Title, v.Message, v.After, v.Ref, v.Target, v.Author, v.AuthorEmail, v.AuthorAvatar, v.Sender, v.Deploy, v.Started, v.Finished, v.Created}}, err
+		},
+	},
+	{
+		name:   "stages",
+		fields: []string{"repo_id", "build_id", "number", "name", "kind", "type", "status", "error", "exit_code", "machine", "os", "arch", "variant", "labels", "started", "stopped"},
+		source: verifyStageSourceQuery,
+		target: verifyStageTargetQuery,
+		from: func(rows *sql.Rows, opts Options) (*verifyRow, error) {
+			v := &StageV0{}
+			err := scanRow(rows, v)
+			labels := stageLabels(v.Environ, opts.StageLabels)
+			name := truncateChars(stageName(v.Name, labels), 100)
+			os, arch, variant, _ := parsePlatform(v.Platform)
+			if len(variant) > maxVariant {
+				variant = ""
+			}
+			return &verifyRow{v.ID, []interface{}{v.RepoID, v.BuildID, v.Number, name, stageKind, stageType, v.State, v.Error, v.ExitCode, v.Machine, os, arch, variant, labels, v.Started, v.Stopped}}, err
+		},
+		to: func(rows *sql.Rows) (*verifyRow, error) {
+			v := &StageV1{}
+			err := scanRow(rows, v)
+			return &verifyRow{v.ID, []interface{}{v.RepoID, v.BuildID, v.Number, v.Name, v.Kind, v.Type, v.Status, v.Error, v.ExitCode, v.Machine, v.OS, v.Arch, v.Variant, v.Labels, v.Started, v.Stopped}}, err
+		},
+	},
+	{
+		name:   "steps",
+		fields: []string{"stage_id", "number", "name", "status", "error", "exit_code", "started", "stopped"},
+		source: verifyStepSourceQuery,
+		target: verifyStepTargetQuery,
+		from: func(rows *sql.Rows, opts Options) (*verifyRow, error) {
+			v := &StepV0{}
+			err := scanRow(rows, v)
+			return &verifyRow{v.ID, []interface{}{v.ParentID, v.PID, v.Name, v.State, v.Error, v.ExitCode, v.Started, v.Stopped}}, err
+		},
+		to: func(rows *sql.Rows) (*verifyRow, error) {
+			v := &StepV1{}
+			err := scanRow(rows, v)
+			return &verifyRow{v.ID, []interface{}{v.StageID, v.Number, v.Name, v.Status, v.Error, v.ExitCode, v.Started, v.Stopped}}, err
+		},
+	},
+	{
+		// logs are compared by the checksum of the converted
+		// log lines, and identified by the step id.
+		name:   "logs",
+		fields: []string{"data"},
+		source: verifyLogSourceQuery,
+		target: verifyLogTargetQuery,
+		from: func(rows *sql.Rows, opts Options) (*verifyRow, error) {
+			v := &LogsV0{}
+			if err := scanRow(rows, v); err != nil {
+				return nil, err
+			}
+			data, _, _ := convertLines(v.Data)
+			return &verifyRow{v.ProcID, []interface{}{checksum(data)}}, nil
+		},
+		to: func(rows *sql.Rows) (*verifyRow, error) {
+			v := &LogsV1{}
+			err := scanRow(rows, v)
+			return &verifyRow{v.ID, []interface{}{checksum(v.Data)}}, err
+		},
+	},
+}
+
+// Verify compares the rows of each migrated entity in the V0
+// database with the rows in the V1 database, and returns the
+// number of rows and the missing, extra and divergent rows of
+// each entity. The named entities in skip are not compared.
+// The V0 rows are converted using the migration options.
+func Verify(source, target *sql.DB, skip []string, opts Options) (*Verification, error) {
+	skipped := map[string]bool{}
+	for _, name := range skip {
+		skipped[name] = true
+	}
+
+	result := &Verification{
+		Entities:    []*EntitySummary{},
+		Differences: []*Difference{},
+	}
+	for _, entity := range verifyEntities {
+		if skipped[entity.name] {
+			logrus.WithField("entity", entity.name).Infoln("skip verification")
+			continue
+		}
+		summary, err := verifyEntityRows(source, target, entity, opts, result)
+		if err != nil {
+			return nil, err
+		}
+		result.Entities = append(result.Entities, summary)
+
+		logrus.WithFields(logrus.Fields{
+			"entity":    entity.name,
+			"source":    summary.Source,
+			"target":    summary.Target,
+			"missing":   summary.Missing,
+			"extra":     summary.Extra,
+			"divergent": summary.Divergent,
+		}).Infoln("verification complete")
+	}
+	return result, nil
+}
+
+// helper function compares the V0 and V1 rows of the entity.
+// Both result sets are ordered by identifier, and are merged
+// one row at a time, so that memory use does not grow with
+// the size of the table. Differences are appended to result.
+func verifyEntityRows(source, target *sql.DB, entity verifyEntity, opts Options, result *Verification) (*EntitySummary, error) {
+	summary := &EntitySummary{Entity: entity.name}
+
+	from := func(rows *sql.Rows) (*verifyRow, error) {
+		return entity.from(rows, opts)
+	}
+	src, err := openVerifyCursor(source, entity.source, from)
+	if err != nil {
+		return nil, err
+	}
+	defer src.rows.Close()
+
+	dst, err := openVerifyCursor(target, entity.target, entity.to)
+	if err != nil {
+		return nil, err
+	}
+	defer dst.rows.Close()
+
+	for src.row != nil || dst.row != nil {
+		diff := &Difference{Entity: entity.name}
+		switch {
+		case dst.row == nil || (src.row != nil && src.row.id < dst.row.id):
+			diff.ID = src.row.id
+			diff.Kind = DifferenceMissing
+			diff.Source = checksumValues(src.row.values)
+			summary.Missing++
+			err = src.next()
+		case src.row == nil || dst.row.id < src.row.id:
+			diff.ID = dst.row.id
+			diff.Kind = DifferenceExtra
+			diff.Target = checksumValues(dst.row.values)
+			summary.Extra++
+			err = dst.next()
+		default:
+			diff.ID = src.row.id
+			diff.Source = checksumValues(src.row.values)
+			diff.Target = checksumValues(dst.row.values)
+			if diff.Source == diff.Target {
+				diff = nil
+			} else {
+				diff.Kind = DifferenceDivergent
+				diff.Fields = divergentFields(entity.fields, src.row.values, dst.row.values)
+				summary.Divergent++
+			}
+			if err = src.next(); err == nil {
+				err = dst.next()
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		if diff != nil {
+			result.Differences = append(result.Differences, diff)
+		}
+	}
+
+	summary.Source = src.count
+	summary.Target = dst.count
+	return summary, nil
+}
+
+// verifyCursor iterates the scanned rows of a result set.
+type verifyCursor struct {
+	rows  *sql.Rows
+	scan  func(*sql.Rows) (*verifyRow, error)
+	row   *verifyRow
+	count int64
+}
+
+// helper function executes the query and scans the first row.
+func openVerifyCursor(db *sql.DB, query string, scan func(*sql.Rows) (*verifyRow, error)) (*verifyCursor, error) {
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	c := &verifyCursor{rows: rows, scan: scan}
+	if err := c.next(); err != nil {
+		rows.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// helper function scans the next row. The row is nil once
+// the result set is exhausted.
+func (c *verifyCursor) next() error {
+	if !c.rows.Next() {
+		c.row = nil
+		return c.rows.Err()
+	}
+	row, err := c.scan(c.rows)
+	if err != nil {
+		return err
+	}
+	c.row = row
+	c.count++
+	return nil
+}
+
+// helper function scans a row that consists of an identifier
+// only.
+func scanVerifyID(rows *sql.Rows) (*verifyRow, error) {
+	row := &verifyRow{values: []interface{}{}}
+	return row, rows.Scan(&row.id)
+}
+
+// helper function returns the names of the fields with
+// different values.
+func divergentFields(fields []string, a, b []interface{}) []string {
+	var names []string
+	for i, name := range fields {
+		if fmt.Sprint(a[i]) != fmt.Sprint(b[i]) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// helper function returns the sha256 checksum of the values.
+func checksumValues(values []interface{}) string {
+	h := sha256.New()
+	for _, v := range values {
+		fmt.Fprintf(h, "%v\x00", v)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// helper function returns the sha256 checksum of the data.
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// helper function truncates the string to n bytes, the same
+// way the migration truncates values that exceed the length
+// of the V1 column.
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
+
+const verifyUserQuery = `
+SELECT *
+FROM users
+ORDER BY user_id
+`
+
+const verifyRepoSourceQuery = `
+SELECT *
+FROM repos
+WHERE repo_user_id > 0
+ORDER BY repo_id
+`
+
+const verifyRepoTargetQuery = `
+SELECT *
+FROM repos
+ORDER BY repo_id
+`
+
+const verifySecretSourceQuery = `
+SELECT secrets.*
+FROM secrets
+INNER JOIN repos ON secrets.secret_repo_id = repos.repo_id
+WHERE repos.repo_user_id > 0
+ORDER BY secrets.secret_id
+`
+
+const verifySecretTargetQuery = `
+SELECT *
+FROM secrets
+WHERE secret_name != '.dockerconfigjson'
+ORDER BY secret_id
+`
+
+const verifyRegistrySourceQuery = `
+SELECT DISTINCT registry_repo_id
+FROM registry
+INNER JOIN repos ON repos.repo_id = registry.registry_repo_id
+WHERE repos.repo_user_id > 0
+ORDER BY registry_repo_id
+`
+
+const verifyRegistryTargetQuery = `
+SELECT secret_repo_id
+FROM secrets
+WHERE secret_name = '.dockerconfigjson'
+ORDER BY secret_repo_id
+`
+
+const verifyBuildQuery = `
+SELECT *
+FROM builds
+ORDER BY build_id
+`
+
+const verifyStageSourceQuery = `
+SELECT procs.*
+      ,builds.build_repo_id AS proc_repo_id
+      ,(SELECT COUNT(*)
+        FROM procs siblings
+        WHERE siblings.proc_build_id = procs.proc_build_id
+          AND siblings.proc_ppid = 0
+          AND siblings.proc_pid <= procs.proc_pid) AS proc_number
+FROM procs
+INNER JOIN builds ON procs.proc_build_id = builds.build_id
+INNER JOIN repos ON builds.build_repo_id = repos.repo_id
+WHERE proc_ppid = 0
+  AND repo_user_id > 0
+ORDER BY proc_id
+`
+
+const verifyStageTargetQuery = `
+SELECT *
+FROM stages
+ORDER BY stage_id
+`
+
+const verifyStepSourceQuery = `
+SELECT procs.*, parent.proc_id AS proc_parent_id
+FROM procs
+INNER JOIN builds ON procs.proc_build_id = builds.build_id
+INNER JOIN repos ON builds.build_repo_id = repos.repo_id
+INNER JOIN procs parent
+  ON parent.proc_build_id = procs.proc_build_id
+ AND parent.proc_pid = procs.proc_ppid
+WHERE procs.proc_ppid != 0
+  AND repo_user_id > 0
+ORDER BY procs.proc_id
+`
+
+const verifyStepTargetQuery = `
+SELECT *
+FROM steps
+ORDER BY step_id
+`
+
+const verifyLogSourceQuery = `
+SELECT logs.*
+FROM logs
+INNER JOIN procs ON logs.log_job_id = procs.proc_id
+INNER JOIN builds ON procs.proc_build_id = builds.build_id
+INNER JOIN repos ON builds.build_repo_id = repos.repo_id
+WHERE proc_ppid != 0
+  AND repo_user_id > 0
+  AND LENGTH(log_data) > 0
+ORDER BY log_job_id
+`
+
+const verifyLogTargetQuery = `
+SELECT *
+FROM logs
+ORDER BY log_id
+`
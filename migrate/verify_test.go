@@ -0,0 +1,74 @@
+package migrate
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/russross/meddler"
+)
+
+func TestVerify(t *testing.T) {
+	source := openSource(t)
+	target := openTarget(t)
+
+	// user 1 matches, user 2 is missing, user 3 has a different
+	// email, and user 4 only exists in the target database.
+	execAll(t, source,
+		`INSERT INTO users (user_id, user_login, user_email) VALUES (1, 'octocat', 'octocat@github.com')`,
+		`INSERT INTO users (user_id, user_login, user_email) VALUES (2, 'spaceghost', 'spaceghost@github.com')`,
+		`INSERT INTO users (user_id, user_login, user_email) VALUES (3, 'hubot', 'hubot@github.com')`,
+	)
+	users := []*UserV1{
+		{ID: 1, Login: "octocat", Email: "octocat@github.com", Hash: "1"},
+		{ID: 3, Login: "hubot", Email: "hubot@example.com", Hash: "3"},
+		{ID: 4, Login: "monalisa", Email: "monalisa@github.com", Hash: "4"},
+	}
+	for _, user := range users {
+		if err := meddler.Insert(target, "users", user); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var skip []string
+	for _, entity := range verifyEntities {
+		if entity.name != "users" {
+			skip = append(skip, entity.name)
+		}
+	}
+	result, err := Verify(source, target, skip, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantSummary := []*EntitySummary{
+		{Entity: "users", Source: 3, Target: 3, Missing: 1, Extra: 1, Divergent: 1},
+	}
+	if !reflect.DeepEqual(result.Entities, wantSummary) {
+		t.Errorf("want summary %+v, got %+v", wantSummary[0], result.Entities[0])
+	}
+
+	type difference struct {
+		id     int64
+		kind   string
+		fields []string
+	}
+	want := []difference{
+		{2, DifferenceMissing, nil},
+		{3, DifferenceDivergent, []string{"email"}},
+		{4, DifferenceExtra, nil},
+	}
+	var got []difference
+	for _, diff := range result.Differences {
+		got = append(got, difference{diff.ID, diff.Kind, diff.Fields})
+
+		// missing rows only have a source checksum, extra rows
+		// only have a target checksum.
+		if (diff.Source == "") != (diff.Kind == DifferenceExtra) ||
+			(diff.Target == "") != (diff.Kind == DifferenceMissing) {
+			t.Errorf("user %d: unexpected checksums for %s row", diff.ID, diff.Kind)
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("want differences %v, got %v", want, got)
+	}
+}